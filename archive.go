@@ -0,0 +1,456 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+const (
+	ARCHIVE_FORMAT_DOCKER  = "docker-archive"
+	DOCKER_ARCHIVE_VERSION = "1.0"
+)
+
+//layer IDs become branch names, "_" would break them
+var archiveLayerIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+//entry of the manifest.json of a docker-archive (docker save format)
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string //base layer first
+}
+
+//krgo export image.tar -r rootfs --format docker-archive
+//write a git layered image as a tarball docker can load: a <id>/{VERSION,json,layer.tar} directory per layer,
+//plus the manifest.json, image config and repositories files. ref names the image in the archive, may be nil
+func exportDockerArchive(rootfs, dest string, ref *imageReference) (err error) {
+	if !isGitRepo(rootfs) {
+		return fmt.Errorf("%v not a git repository", rootfs)
+	}
+	gitRepo, _ := newGitRepo(rootfs)
+	if err := checkCommitted(gitRepo); err != nil {
+		return err
+	}
+
+	blobs, err := layerBlobs(gitRepo)
+	if err != nil {
+		return err
+	}
+	if len(blobs) == 0 {
+		return fmt.Errorf("no git layer branch in %v", rootfs)
+	}
+	defer func() {
+		for _, blob := range blobs {
+			if blob.SpoolPath != "" {
+				os.Remove(blob.SpoolPath)
+			}
+		}
+	}()
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(dest)
+		}
+	}()
+	tw := tar.NewWriter(f)
+
+	printf("Exporting %d layers:\n", len(blobs))
+	manifest := dockerArchiveManifest{}
+	var diffIDs []string
+	for _, blob := range blobs {
+		printf("\t%v ... ", blob.Branch)
+		if err := spoolLayerBlob(gitRepo, blob); err != nil {
+			return err
+		}
+		id := blob.Branch.imageID()
+		if err := writeArchiveFile(tw, path.Join(id, "VERSION"), []byte(DOCKER_ARCHIVE_VERSION)); err != nil {
+			return err
+		}
+		if err := writeArchiveFile(tw, path.Join(id, "json"), []byte(blob.V1Compat)); err != nil {
+			return err
+		}
+		diffID, err := writeArchiveLayer(tw, path.Join(id, "layer.tar"), blob.SpoolPath)
+		if err != nil {
+			return err
+		}
+		diffIDs = append(diffIDs, diffID)
+		manifest.Layers = append(manifest.Layers, path.Join(id, "layer.tar"))
+		printf("done\n")
+		//layers are spooled one at a time
+		os.Remove(blob.SpoolPath)
+		blob.SpoolPath = ""
+	}
+
+	//image config, named after its digest like docker does
+	topID := blobs[len(blobs)-1].Branch.imageID()
+	config, err := imageConfigFromV1JSON([]byte(blobs[len(blobs)-1].V1Compat), diffIDs)
+	if err != nil {
+		return err
+	}
+	configDigest, _ := computeDigest("sha256", config)
+	manifest.Config = configDigest[len("sha256:"):] + ".json"
+	if err := writeArchiveFile(tw, manifest.Config, config); err != nil {
+		return err
+	}
+
+	//legacy repositories file, read by docker versions without manifest.json support
+	if ref != nil {
+		manifest.RepoTags = []string{ref.familiarName() + ":" + ref.Tag}
+		repositories, err := json.Marshal(map[string]map[string]string{ref.familiarName(): {ref.Tag: topID}})
+		if err != nil {
+			return err
+		}
+		if err := writeArchiveFile(tw, "repositories", repositories); err != nil {
+			return err
+		}
+	}
+	rawManifest, err := json.Marshal([]dockerArchiveManifest{manifest})
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(tw, "manifest.json", rawManifest); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+//layer of a loaded docker-archive
+type archiveLayer struct {
+	ID   string
+	Path string //extracted layer tar
+	JSON []byte //nil if the archive has no json for the layer
+}
+
+//krgo load image.tar -r rootfs
+//load a docker-archive tarball into a git layered rootfs, the way pull -g does: a layer_<n>_<id> branch per
+//layer with its json and layersize files. ref selects the image of archives holding several, may be nil
+func loadDockerArchive(src, rootfsDest string, ref *imageReference) (err error) {
+	if isGitRepo(rootfsDest) {
+		return fmt.Errorf("%v is already a git repository", rootfsDest)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	//archive entries come in any order, the archive is extracted before layers are applied
+	tmpDir, err := ioutil.TempDir("", "krgo_load_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	printf("Extracting %v ...\n", src)
+	if err := extractArchiveFiles(f, tmpDir); err != nil {
+		return err
+	}
+	layers, config, err := dockerArchiveLayers(tmpDir, ref)
+	if err != nil {
+		return err
+	}
+
+	rootfsCreated := !fileExists(rootfsDest)
+	defer func() {
+		if err != nil && rootfsCreated {
+			printf("Load failed, removing %v\n", rootfsDest)
+			os.RemoveAll(rootfsDest)
+		}
+	}()
+	if err := os.MkdirAll(rootfsDest, 0700); err != nil {
+		return err
+	}
+	gitRepo, err := newGitRepo(rootfsDest)
+	if err != nil {
+		return err
+	}
+
+	printf("Applying %d layers:\n", len(layers))
+	for i, layer := range layers {
+		if _, err := gitRepo.checkoutB(newBranch(i, layer.ID)); err != nil {
+			return err
+		}
+		size, err := applyArchiveLayer(rootfsDest, layer.Path)
+		if err != nil {
+			return err
+		}
+
+		jsonRaw := layer.JSON
+		if jsonRaw == nil {
+			//image metadata goes with the top layer, like V2 pulls
+			parent := ""
+			if i > 0 {
+				parent = layers[i-1].ID
+			}
+			var rawConfig []byte
+			if i == len(layers)-1 {
+				rawConfig = config
+			}
+			if jsonRaw, err = v1ImageJSON(rawConfig, layer.ID, parent); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(path.Join(rootfsDest, "json"), jsonRaw, 0644); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(rootfsDest, "layersize"), []byte(strconv.FormatInt(size, 10)), 0644); err != nil {
+			return err
+		}
+		if _, err := gitRepo.addAllAndCommit("adding layer " + layer.ID); err != nil {
+			return err
+		}
+		printf("\t%s (%.2f MB) applied\n", layer.ID, float64(size)/ONE_MB)
+	}
+	return nil
+}
+
+//apply the layer tar at layerPath to rootfs, return the size of the layer tar
+func applyArchiveLayer(rootfs, layerPath string) (int64, error) {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	//compressed layers (OCI archives) are decompressed by ApplyLayer
+	_, err = archive.ApplyLayer(rootfs, f)
+	return fi.Size(), err
+}
+
+//extract regular files and symlinks (docker save links identical layers) of the tar read from r into dest.
+//Entries can't escape dest
+func extractArchiveFiles(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		target := filepath.Join(dest, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			//links are resolved inside dest
+			linked := hdr.Linkname
+			if !path.IsAbs(linked) {
+				linked = path.Join(path.Dir(name), linked)
+			}
+			if linked = path.Clean("/" + linked); linked == "/" {
+				return fmt.Errorf("invalid link %v -> %v in archive", hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			if err := os.Symlink(filepath.Join(dest, filepath.FromSlash(linked)), target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//layers (base layer first) and image config of the image of the docker-archive extracted in dir. manifest.json
+//is used if present, the legacy repositories file and layer jsons otherwise
+func dockerArchiveLayers(dir string, ref *imageReference) ([]*archiveLayer, []byte, error) {
+	var layers []*archiveLayer
+	rawManifest, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if os.IsNotExist(err) {
+		layers, err = legacyArchiveLayers(dir, ref)
+		return layers, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var manifests []dockerArchiveManifest
+	if err := json.Unmarshal(rawManifest, &manifests); err != nil {
+		return nil, nil, fmt.Errorf("invalid archive manifest.json: %v", err)
+	}
+	var repoTags [][]string
+	for _, m := range manifests {
+		repoTags = append(repoTags, m.RepoTags)
+	}
+	i, err := selectArchiveImage(repoTags, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest := manifests[i]
+
+	config, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+manifest.Config))))
+	if err != nil {
+		return nil, nil, fmt.Errorf("image config of the archive: %v", err)
+	}
+	for _, layerPath := range manifest.Layers {
+		layerPath = path.Clean("/" + layerPath)
+		layer := &archiveLayer{Path: filepath.Join(dir, filepath.FromSlash(layerPath))}
+		if path.Base(layerPath) == "layer.tar" {
+			//<id>/layer.tar, the layer json is next to it
+			layer.ID = path.Base(path.Dir(layerPath))
+			if jsonRaw, err := ioutil.ReadFile(filepath.Join(filepath.Dir(layer.Path), "json")); err == nil {
+				layer.JSON = jsonRaw
+			}
+		} else {
+			//blobs/sha256/<hex>
+			layer.ID = path.Base(layerPath)
+		}
+		if !archiveLayerIDRegexp.MatchString(layer.ID) {
+			return nil, nil, fmt.Errorf("invalid layer %v in archive", layerPath)
+		}
+		layers = append(layers, layer)
+	}
+	if len(layers) == 0 {
+		return nil, nil, fmt.Errorf("image of the archive has no layers")
+	}
+	return layers, config, nil
+}
+
+//layers of archives written by docker versions without manifest.json: the top layer is given by the
+//repositories file, the other ones by following layer json parents
+func legacyArchiveLayers(dir string, ref *imageReference) ([]*archiveLayer, error) {
+	rawRepositories, err := ioutil.ReadFile(filepath.Join(dir, "repositories"))
+	if err != nil {
+		return nil, fmt.Errorf("archive has neither manifest.json nor repositories file")
+	}
+	repositories := make(map[string]map[string]string)
+	if err := json.Unmarshal(rawRepositories, &repositories); err != nil {
+		return nil, fmt.Errorf("invalid archive repositories file: %v", err)
+	}
+	var (
+		repoTags [][]string
+		ids      []string
+	)
+	for name, tags := range repositories {
+		for tag, id := range tags {
+			repoTags = append(repoTags, []string{name + ":" + tag})
+			ids = append(ids, id)
+		}
+	}
+	i, err := selectArchiveImage(repoTags, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var layers []*archiveLayer
+	seen := make(map[string]bool)
+	for id := ids[i]; id != ""; {
+		if !archiveLayerIDRegexp.MatchString(id) || seen[id] {
+			return nil, fmt.Errorf("invalid layer %v in archive", id)
+		}
+		seen[id] = true
+		jsonRaw, err := ioutil.ReadFile(filepath.Join(dir, id, "json"))
+		if err != nil {
+			return nil, fmt.Errorf("layer %v json: %v", id, err)
+		}
+		var img struct {
+			Parent string `json:"parent"`
+		}
+		if err := json.Unmarshal(jsonRaw, &img); err != nil {
+			return nil, fmt.Errorf("layer %v json: %v", id, err)
+		}
+		layers = append([]*archiveLayer{{ID: id, Path: filepath.Join(dir, id, "layer.tar"), JSON: jsonRaw}}, layers...)
+		id = img.Parent
+	}
+	return layers, nil
+}
+
+//index of the image named ref among images tagged repoTags. ref may be nil if there is only one image
+func selectArchiveImage(repoTags [][]string, ref *imageReference) (int, error) {
+	if len(repoTags) == 0 {
+		return 0, fmt.Errorf("archive has no image")
+	}
+	if ref == nil {
+		if len(repoTags) > 1 {
+			return 0, fmt.Errorf("archive has %d images, select one with -t (available: %v)", len(repoTags), archiveTags(repoTags))
+		}
+		return 0, nil
+	}
+	name := ref.familiarName() + ":" + ref.Tag
+	for i, tags := range repoTags {
+		for _, tag := range tags {
+			if tag == name || tag == ref.Name+":"+ref.Tag {
+				return i, nil
+			}
+		}
+	}
+	return 0, withExitCode(EXIT_NOT_FOUND, fmt.Errorf("image %v not found in archive (available: %v)", name, archiveTags(repoTags)))
+}
+
+func archiveTags(repoTags [][]string) string {
+	var all []string
+	for _, tags := range repoTags {
+		all = append(all, tags...)
+	}
+	if len(all) == 0 {
+		return "untagged images"
+	}
+	sort.Strings(all)
+	return strings.Join(all, ", ")
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, content []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+//write the layer tar spooled in spoolPath, return its sha256 digest (the layer diff ID)
+func writeArchiveLayer(tw *tar.Writer, name, spoolPath string) (string, error) {
+	f, err := os.Open(spoolPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(tw, io.TeeReader(f, h)); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteArchiveLayer(t *testing.T) {
+	fmt.Printf("Testing docker archive layer ... ")
+	spool, err := ioutil.TempFile("", "krgo_test_layer_")
+	asserErrNil(err, t)
+	defer os.Remove(spool.Name())
+	content := []byte("layer content")
+	spool.Write(content)
+	spool.Close()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	asserErrNil(writeArchiveFile(tw, "id/VERSION", []byte(DOCKER_ARCHIVE_VERSION)), t)
+	diffID, err := writeArchiveLayer(tw, "id/layer.tar", spool.Name())
+	asserErrNil(err, t)
+	asserErrNil(tw.Close(), t)
+
+	expected, _ := computeDigest("sha256", content)
+	if diffID != expected {
+		t.Fatalf("expected diff ID %v got %v", expected, diffID)
+	}
+
+	tr := tar.NewReader(buf)
+	for _, name := range []string{"id/VERSION", "id/layer.tar"} {
+		hdr, err := tr.Next()
+		asserErrNil(err, t)
+		data, _ := ioutil.ReadAll(tr)
+		if hdr.Name != name || hdr.Size != int64(len(data)) {
+			t.Fatalf("unexpected entry %v (%d bytes)", hdr.Name, hdr.Size)
+		}
+	}
+	fmt.Printf("OK\n")
+}
+
+//write a tar of name -> content entries, content starting with "->" are symlinks
+func writeTestArchive(t *testing.T, entries [][2]string) string {
+	f, err := ioutil.TempFile("", "krgo_test_archive_")
+	asserErrNil(err, t)
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		if len(e[1]) > 2 && e[1][:2] == "->" {
+			asserErrNil(tw.WriteHeader(&tar.Header{Name: e[0], Linkname: e[1][2:], Typeflag: tar.TypeSymlink}), t)
+			continue
+		}
+		asserErrNil(writeArchiveFile(tw, e[0], []byte(e[1])), t)
+	}
+	asserErrNil(tw.Close(), t)
+	return f.Name()
+}
+
+func extractTestArchive(t *testing.T, entries [][2]string) string {
+	src := writeTestArchive(t, entries)
+	defer os.Remove(src)
+	dir, err := ioutil.TempDir("", "krgo_test_extract_")
+	asserErrNil(err, t)
+	f, err := os.Open(src)
+	asserErrNil(err, t)
+	defer f.Close()
+	asserErrNil(extractArchiveFiles(f, dir), t)
+	return dir
+}
+
+func TestDockerArchiveLayers(t *testing.T) {
+	fmt.Printf("Testing docker archive loading ... ")
+	//docker save layout: layers may come after the manifest and identical layers are links
+	dir := extractTestArchive(t, [][2]string{
+		{"manifest.json", `[{"Config":"cfg.json","RepoTags":["busybox:latest"],"Layers":["aaa/layer.tar","bbb/layer.tar","ccc/layer.tar"]}]`},
+		{"cfg.json", `{"os":"linux"}`},
+		{"aaa/json", `{"id":"aaa"}`},
+		{"aaa/layer.tar", "base"},
+		{"bbb/layer.tar", "->../aaa/layer.tar"},
+		{"ccc/layer.tar", "top"},
+		{"../../escaped", "nope"},
+	})
+	defer os.RemoveAll(dir)
+	if !fileExists(dir + "/escaped") {
+		t.Fatal("expected escaping entries to be extracted inside the destination")
+	}
+
+	layers, config, err := dockerArchiveLayers(dir, nil)
+	asserErrNil(err, t)
+	if string(config) != `{"os":"linux"}` || len(layers) != 3 {
+		t.Fatalf("unexpected layers %v config %s", layers, config)
+	}
+	if layers[0].ID != "aaa" || string(layers[0].JSON) != `{"id":"aaa"}` || layers[1].JSON != nil || layers[2].ID != "ccc" {
+		t.Fatalf("unexpected layers %+v %+v %+v", layers[0], layers[1], layers[2])
+	}
+	if content, err := ioutil.ReadFile(layers[1].Path); err != nil || string(content) != "base" {
+		t.Fatalf("expected the linked layer content got %q (%v)", content, err)
+	}
+
+	ref, _ := parseImageReference("busybox:other", "")
+	if _, _, err := dockerArchiveLayers(dir, ref); err == nil || exitCode(err) != EXIT_NOT_FOUND || !strings.Contains(err.Error(), "busybox:latest") {
+		t.Fatalf("expected a not found error listing the archive images got %v", err)
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestLegacyDockerArchiveLayers(t *testing.T) {
+	fmt.Printf("Testing legacy docker archive loading ... ")
+	dir := extractTestArchive(t, [][2]string{
+		{"repositories", `{"busybox":{"latest":"top"},"debian":{"8":"other"}}`},
+		{"top/json", `{"id":"top","parent":"base"}`},
+		{"top/layer.tar", "top"},
+		{"base/json", `{"id":"base"}`},
+		{"base/layer.tar", "base"},
+	})
+	defer os.RemoveAll(dir)
+
+	if _, _, err := dockerArchiveLayers(dir, nil); err == nil || !strings.Contains(err.Error(), "busybox:latest, debian:8") {
+		t.Fatalf("expected an error listing the archive images got %v", err)
+	}
+	ref, _ := parseImageReference("busybox", "")
+	layers, _, err := dockerArchiveLayers(dir, ref)
+	asserErrNil(err, t)
+	if len(layers) != 2 || layers[0].ID != "base" || layers[1].ID != "top" || layers[1].JSON == nil {
+		t.Fatalf("unexpected layers %v", layers)
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestDockerArchiveRoundTrip(t *testing.T) {
+	fmt.Printf("Testing docker archive export and load ... ")
+	repoPath := "/tmp/git_repo_archive"
+	r := newTestLayeredRepo(repoPath, t)
+	defer os.RemoveAll(repoPath)
+	tarball := "/tmp/krgo_test_roundtrip.tar"
+	defer os.Remove(tarball)
+	loaded := "/tmp/git_repo_loaded"
+	defer os.RemoveAll(loaded)
+
+	ref, err := parseImageReference("krgo/roundtrip:test", "")
+	asserErrNil(err, t)
+	asserErrNil(exportDockerArchive(repoPath, tarball, ref), t)
+
+	//each layer.tar holds the changes of its own branch, and the config lists their digests
+	dir, err := ioutil.TempDir("", "krgo_test_roundtrip_")
+	asserErrNil(err, t)
+	defer os.RemoveAll(dir)
+	f, err := os.Open(tarball)
+	asserErrNil(err, t)
+	asserErrNil(extractArchiveFiles(f, dir), t)
+	f.Close()
+	layers, rawConfig, err := dockerArchiveLayers(dir, nil)
+	asserErrNil(err, t)
+	config := &struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}{}
+	asserErrNil(json.Unmarshal(rawConfig, config), t)
+	if len(layers) != len(testLayers) || len(config.RootFS.DiffIDs) != len(testLayers) {
+		t.Fatalf("expected %d layers got %d (%d diff IDs)", len(testLayers), len(layers), len(config.RootFS.DiffIDs))
+	}
+	for i, layer := range layers {
+		data, err := ioutil.ReadFile(layer.Path)
+		asserErrNil(err, t)
+		if diffID, _ := computeDigest("sha256", data); diffID != config.RootFS.DiffIDs[i] {
+			t.Fatalf("layer %d: expected diff ID %v got %v", i, config.RootFS.DiffIDs[i], diffID)
+		}
+		tarShouldContain(bytes.NewReader(data), testLayers[i], nil, t)
+	}
+
+	//loading it back gives the same layers
+	asserErrNil(loadDockerArchive(tarball, loaded, nil), t)
+	loadedRepo, err := newGitRepo(loaded)
+	asserErrNil(err, t)
+	brs, err := r.branch()
+	asserErrNil(err, t)
+	for _, br := range brs {
+		original, err := r.showFile(br, "a.txt")
+		loadedContent, loadedErr := loadedRepo.showFile(br, "a.txt")
+		if (err == nil) != (loadedErr == nil) || string(original) != string(loadedContent) {
+			t.Fatalf("%v: expected a.txt %q got %q (%v)", br, original, loadedContent, loadedErr)
+		}
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestDockerArchiveManyLayers(t *testing.T) {
+	fmt.Printf("Testing docker archive export with more than 10 layers ... ")
+	repoPath := "/tmp/git_repo_archive_many"
+	r := newTestManyLayersRepo(repoPath, 12, t)
+	defer os.RemoveAll(repoPath)
+	tarball := "/tmp/krgo_test_many_layers.tar"
+	defer os.Remove(tarball)
+
+	ref, err := parseImageReference("krgo/many:test", "")
+	asserErrNil(err, t)
+	asserErrNil(exportDockerArchive(r.Path, tarball, ref), t)
+
+	dir, err := ioutil.TempDir("", "krgo_test_many_layers_")
+	asserErrNil(err, t)
+	defer os.RemoveAll(dir)
+	f, err := os.Open(tarball)
+	asserErrNil(err, t)
+	asserErrNil(extractArchiveFiles(f, dir), t)
+	f.Close()
+	layers, _, err := dockerArchiveLayers(dir, nil)
+	asserErrNil(err, t)
+	if len(layers) != 12 {
+		t.Fatalf("expected 12 layers got %d", len(layers))
+	}
+	for i, layer := range layers {
+		f, err := os.Open(layer.Path)
+		asserErrNil(err, t)
+		files, unexpected := manyLayersFiles(i, len(layers))
+		tarShouldContain(f, files, unexpected, t)
+		f.Close()
+	}
+	fmt.Printf("OK\n")
+}
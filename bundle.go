@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	OCI_RUNTIME_VERSION = "1.0.2"
+	DEFAULT_HOSTNAME    = "krgo"
+	BUNDLE_CONFIG       = "config.json"
+)
+
+//capabilities docker grants by default
+var defaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+//OCI runtime spec (config.json), only what krgo fills
+type runtimeSpec struct {
+	OCIVersion string         `json:"ociVersion"`
+	Process    runtimeProcess `json:"process"`
+	Root       runtimeRoot    `json:"root"`
+	Hostname   string         `json:"hostname"`
+	Mounts     []runtimeMount `json:"mounts"`
+	Linux      runtimeLinux   `json:"linux"`
+}
+
+type runtimeProcess struct {
+	Terminal        bool                `json:"terminal"`
+	User            runtimeUser         `json:"user"`
+	Args            []string            `json:"args"`
+	Env             []string            `json:"env"`
+	Cwd             string              `json:"cwd"`
+	Capabilities    runtimeCapabilities `json:"capabilities"`
+	Rlimits         []runtimeRlimit     `json:"rlimits"`
+	NoNewPrivileges bool                `json:"noNewPrivileges"`
+}
+
+type runtimeUser struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+type runtimeCapabilities struct {
+	Bounding    []string `json:"bounding"`
+	Effective   []string `json:"effective"`
+	Inheritable []string `json:"inheritable,omitempty"`
+	Permitted   []string `json:"permitted"`
+}
+
+type runtimeRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type runtimeRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type runtimeMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type runtimeLinux struct {
+	Namespaces    []runtimeNamespace `json:"namespaces"`
+	Resources     runtimeResources   `json:"resources"`
+	MaskedPaths   []string           `json:"maskedPaths"`
+	ReadonlyPaths []string           `json:"readonlyPaths"`
+}
+
+type runtimeNamespace struct {
+	Type string `json:"type"`
+}
+
+type runtimeResources struct {
+	Devices []runtimeDeviceCgroup `json:"devices"`
+}
+
+type runtimeDeviceCgroup struct {
+	Allow  bool   `json:"allow"`
+	Access string `json:"access"`
+}
+
+//write a runc config.json for the image of rootfs in bundleDir (default: the rootfs parent directory)
+func createBundle(rootfs, bundleDir string, tty bool) (string, error) {
+	img, err := readImageJSON(rootfs)
+	if err != nil {
+		return "", err
+	}
+	if img.OS != "" && img.OS != "linux" {
+		return "", fmt.Errorf("can't bundle %v images, runc only runs linux ones", img.OS)
+	}
+	host := &platform{OS: "linux", Architecture: hostPlatform().Architecture}
+	if img.Architecture != "" && !host.matches(&platform{OS: "linux", Architecture: img.Architecture}) {
+		printf("WARNING: image is built for %v, it may not run on %v\n", img.Architecture, host.Architecture)
+	}
+	if bundleDir == "" {
+		bundleDir = filepath.Dir(rootfs)
+	}
+
+	spec, err := newRuntimeSpec(img, rootfs, tty)
+	if err != nil {
+		return "", err
+	}
+	if spec.Root.Path, err = bundleRootPath(rootfs, bundleDir); err != nil {
+		return "", err
+	}
+	if volumes := img.volumes(); len(volumes) > 0 {
+		printf("Image declares volumes %v, add them to the mounts of %v to persist their data\n", strings.Join(volumes, ", "), BUNDLE_CONFIG)
+	}
+
+	specJSON, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	configPath := filepath.Join(bundleDir, BUNDLE_CONFIG)
+	return configPath, ioutil.WriteFile(configPath, append(specJSON, '\n'), 0644)
+}
+
+//root.path of the spec: relative to the bundle when rootfs is inside it
+func bundleRootPath(rootfs, bundleDir string) (string, error) {
+	absRootfs, err := filepath.Abs(rootfs)
+	if err != nil {
+		return "", err
+	}
+	absBundle, err := filepath.Abs(bundleDir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absBundle, absRootfs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return absRootfs, nil
+	}
+	return rel, nil
+}
+
+func newRuntimeSpec(img *imageJSON, rootfs string, tty bool) (*runtimeSpec, error) {
+	args, err := img.args()
+	if err != nil {
+		return nil, err
+	}
+	user, err := resolveUser(rootfs, img.Config.User)
+	if err != nil {
+		return nil, err
+	}
+	env := img.env(user)
+	if tty && !hasEnv(env, "TERM") {
+		env = append(env, "TERM=xterm")
+	}
+
+	return &runtimeSpec{
+		OCIVersion: OCI_RUNTIME_VERSION,
+		Process: runtimeProcess{
+			Terminal: tty,
+			User:     runtimeUser{UID: user.UID, GID: user.GID, AdditionalGids: user.AdditionalGids},
+			Args:     args,
+			Env:      env,
+			Cwd:      img.workingDir(),
+			//no inheritable capabilities, they would be kept across execve of non root programs (CVE-2022-24769)
+			Capabilities: runtimeCapabilities{
+				Bounding:  defaultCapabilities,
+				Effective: defaultCapabilities,
+				Permitted: defaultCapabilities,
+			},
+			Rlimits:         []runtimeRlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024}},
+			NoNewPrivileges: true,
+		},
+		Hostname: DEFAULT_HOSTNAME,
+		Mounts: []runtimeMount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		},
+		Linux: runtimeLinux{
+			Namespaces: []runtimeNamespace{{"pid"}, {"network"}, {"ipc"}, {"uts"}, {"mount"}},
+			Resources:  runtimeResources{Devices: []runtimeDeviceCgroup{{Allow: false, Access: "rwm"}}},
+			MaskedPaths: []string{
+				"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys", "/proc/latency_stats",
+				"/proc/timer_list", "/proc/timer_stats", "/proc/sched_debug", "/sys/firmware", "/proc/scsi",
+			},
+			ReadonlyPaths: []string{
+				"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+			},
+		},
+	}, nil
+}
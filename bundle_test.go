@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+const (
+	testPasswd = "root:x:0:0:root:/root:/bin/sh\n# comment\nwww:x:33:33:www:/var/www:/bin/false\n"
+	testGroup  = "root:x:0:\nwww:x:33:\nstaff:x:50:bob,www\n"
+)
+
+//rootfs with the given image config and /etc/passwd and /etc/group
+func writeTestRootfs(t *testing.T, config string) string {
+	dir, err := ioutil.TempDir("", "krgo_test_bundle_")
+	asserErrNil(err, t)
+	rootfs := path.Join(dir, "rootfs")
+	asserErrNil(os.MkdirAll(path.Join(rootfs, "etc"), 0755), t)
+	asserErrNil(ioutil.WriteFile(path.Join(rootfs, "etc", "passwd"), []byte(testPasswd), 0644), t)
+	asserErrNil(ioutil.WriteFile(path.Join(rootfs, "etc", "group"), []byte(testGroup), 0644), t)
+	asserErrNil(ioutil.WriteFile(path.Join(rootfs, "json"), []byte(`{"architecture": "", "os": "linux", "config": `+config+`}`), 0644), t)
+	return rootfs
+}
+
+func TestResolveUser(t *testing.T) {
+	fmt.Printf("Testing image user resolution ... ")
+	rootfs := writeTestRootfs(t, "{}")
+	defer os.RemoveAll(path.Dir(rootfs))
+
+	tests := []struct {
+		spec     string
+		expected execUser
+	}{
+		{"", execUser{Name: "root", Home: "/root"}},
+		{"www", execUser{Name: "www", UID: 33, GID: 33, AdditionalGids: []uint32{50}, Home: "/var/www"}},
+		{"33:staff", execUser{Name: "www", UID: 33, GID: 50, Home: "/var/www"}},
+		{"1000:1000", execUser{UID: 1000, GID: 1000, Home: "/"}},
+	}
+	for _, test := range tests {
+		u, err := resolveUser(rootfs, test.spec)
+		asserErrNil(err, t)
+		if !reflect.DeepEqual(*u, test.expected) {
+			t.Fatalf("user %q: expected %+v got %+v", test.spec, test.expected, *u)
+		}
+	}
+	for _, spec := range []string{"nobody", "www:nogroup"} {
+		if _, err := resolveUser(rootfs, spec); err == nil {
+			t.Fatalf("expected user %q not to be found", spec)
+		}
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestPathInRootfs(t *testing.T) {
+	fmt.Printf("Testing rootfs path resolution ... ")
+	rootfs := writeTestRootfs(t, "{}")
+	defer os.RemoveAll(path.Dir(rootfs))
+	asserErrNil(os.Symlink("/etc", path.Join(rootfs, "abs")), t)
+	asserErrNil(os.Symlink("../../../../etc/passwd", path.Join(rootfs, "etc", "escape")), t)
+	asserErrNil(os.Symlink("loop", path.Join(rootfs, "loop")), t)
+
+	//symlinks can't lead out of the rootfs
+	for p, expected := range map[string]string{
+		"/abs/passwd":     path.Join(rootfs, "etc", "passwd"),
+		"/etc/escape":     path.Join(rootfs, "etc", "passwd"),
+		"../../etc/group": path.Join(rootfs, "etc", "group"),
+	} {
+		resolved, err := pathInRootfs(rootfs, p)
+		asserErrNil(err, t)
+		if resolved != expected {
+			t.Fatalf("%v: expected %v got %v", p, expected, resolved)
+		}
+	}
+	if _, err := pathInRootfs(rootfs, "/loop"); err == nil {
+		t.Fatalf("expected symlink loop to fail")
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestCreateBundle(t *testing.T) {
+	fmt.Printf("Testing bundle creation ... ")
+	rootfs := writeTestRootfs(t, `{"Env": ["FOO=bar"], "Entrypoint": ["/entry.sh"], "Cmd": ["serve"], "WorkingDir": "/app", "User": "www", "Volumes": {"/data": {}}}`)
+	defer os.RemoveAll(path.Dir(rootfs))
+
+	configPath, err := createBundle(rootfs, "", true)
+	asserErrNil(err, t)
+	if configPath != path.Join(path.Dir(rootfs), BUNDLE_CONFIG) {
+		t.Fatalf("unexpected config path %v", configPath)
+	}
+	raw, err := ioutil.ReadFile(configPath)
+	asserErrNil(err, t)
+	spec := &runtimeSpec{}
+	asserErrNil(json.Unmarshal(raw, spec), t)
+
+	if spec.Root.Path != "rootfs" || spec.OCIVersion != OCI_RUNTIME_VERSION || !spec.Process.Terminal {
+		t.Fatalf("unexpected spec %+v", spec)
+	}
+	p := spec.Process
+	if !reflect.DeepEqual(p.Args, []string{"/entry.sh", "serve"}) || p.Cwd != "/app" {
+		t.Fatalf("unexpected process %+v", p)
+	}
+	if !reflect.DeepEqual(p.Env, []string{"FOO=bar", DEFAULT_PATH_ENV, "HOME=/var/www", "TERM=xterm"}) {
+		t.Fatalf("unexpected env %v", p.Env)
+	}
+	if p.User.UID != 33 || p.User.GID != 33 || !reflect.DeepEqual(p.User.AdditionalGids, []uint32{50}) {
+		t.Fatalf("unexpected user %+v", p.User)
+	}
+	if len(spec.Mounts) == 0 || spec.Mounts[0].Destination != "/proc" || len(p.Capabilities.Bounding) != len(defaultCapabilities) {
+		t.Fatalf("expected default mounts and capabilities")
+	}
+	if len(p.Capabilities.Inheritable) != 0 || !reflect.DeepEqual(p.Capabilities.Permitted, defaultCapabilities) {
+		t.Fatalf("expected no inheritable capabilities got %+v", p.Capabilities)
+	}
+
+	//rootfs outside of the bundle
+	bundleDir, err := ioutil.TempDir("", "krgo_test_bundle_dir_")
+	asserErrNil(err, t)
+	defer os.RemoveAll(bundleDir)
+	configPath, err = createBundle(rootfs, bundleDir, false)
+	asserErrNil(err, t)
+	raw, _ = ioutil.ReadFile(configPath)
+	asserErrNil(json.Unmarshal(raw, spec), t)
+	if spec.Root.Path != rootfs {
+		t.Fatalf("expected absolute root path %v got %v", rootfs, spec.Root.Path)
+	}
+
+	//nothing to run
+	asserErrNil(ioutil.WriteFile(path.Join(rootfs, "json"), []byte(`{"config": {"Env": ["A=b"]}}`), 0644), t)
+	if _, err := createBundle(rootfs, "", false); err == nil {
+		t.Fatalf("expected an image without Cmd nor Entrypoint to fail")
+	}
+	fmt.Printf("OK\n")
+}
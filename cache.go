@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	BLOBS_DIR     = "blobs"
+	V1_LAYERS_DIR = "v1"    //V1 layers have no content digest, they are stored by ID
+	V1_INFO_EXT   = ".json" //metadata of V1 layers (json and content digest), stored next to them
+	CACHE_TMP_EXT = ".tmp"  //entries being written
+
+	NO_SIZE_LIMIT = int64(-1)
+	NO_AGE_LIMIT  = time.Duration(0)
+)
+
+var ErrCacheMiss = fmt.Errorf("not in cache")
+
+//local store of downloaded layers shared by every pulls: blobs/<algorithm>/<hex> for V2 blobs and
+//blobs/v1/<layer id> (plus its json metadata) for V1 layers
+type blobCache struct {
+	root string
+}
+
+type cacheEntry struct {
+	Key     string
+	Path    string
+	Size    int64
+	ModTime time.Time //last time the entry was used
+}
+
+func newBlobCache() *blobCache {
+	return &blobCache{root: path.Join(krgoHome(), BLOBS_DIR)}
+}
+
+//key of a V1 layer
+func v1CacheKey(layerID string) string {
+	return V1_LAYERS_DIR + ":" + layerID
+}
+
+func (c *blobCache) path(key string) (string, error) {
+	chunks := strings.SplitN(key, ":", 2)
+	if len(chunks) != 2 || chunks[0] == "" || chunks[1] == "" || strings.ContainsAny(key, "/\\") {
+		return "", fmt.Errorf("invalid cache key %q", key)
+	}
+	return path.Join(c.root, chunks[0], chunks[1]), nil
+}
+
+//open a cached blob, its modification time is updated so pruning by age spares recently used entries
+func (c *blobCache) get(key string) (*os.File, int64, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, 0, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return f, fi.Size(), nil
+}
+
+//metadata of a cached V1 layer. V1 layers have no digest, the one of their content is recorded when they are
+//cached so they can be verified
+type v1CacheInfo struct {
+	JSON   json.RawMessage `json:"json"`
+	Digest string          `json:"digest"`
+}
+
+func (c *blobCache) getV1Info(layerID string) (*v1CacheInfo, error) {
+	p, err := c.path(v1CacheKey(layerID))
+	if err != nil {
+		return nil, err
+	}
+	rawInfo, err := ioutil.ReadFile(p + V1_INFO_EXT)
+	if os.IsNotExist(err) {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := &v1CacheInfo{}
+	if err := json.Unmarshal(rawInfo, info); err != nil || info.Digest == "" || len(info.JSON) == 0 {
+		//cached by a krgo version that didn't record digests
+		return nil, fmt.Errorf("invalid layer metadata")
+	}
+	return info, nil
+}
+
+//add the content of file src to the cache. src is hard linked when possible, copied otherwise
+func (c *blobCache) put(key, src string) error {
+	p, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	if fileExists(p) {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		return err
+	}
+	if err := os.Link(src, p); err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	//different file systems, copy then rename so concurrent pulls never see a partial entry
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(path.Dir(p), path.Base(p)+CACHE_TMP_EXT)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+//add the metadata of a V1 layer: its json and the digest of its content, must be done before adding the layer itself
+func (c *blobCache) putV1Info(layerID string, layerJSON []byte, digest string) error {
+	p, err := c.path(v1CacheKey(layerID))
+	if err != nil {
+		return err
+	}
+	rawInfo, err := json.Marshal(&v1CacheInfo{JSON: layerJSON, Digest: digest})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p+V1_INFO_EXT, rawInfo, 0600)
+}
+
+//remove the entry of key from the cache
+func (c *blobCache) evict(key string) error {
+	p, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	return c.remove(&cacheEntry{Key: key, Path: p})
+}
+
+func (c *blobCache) remove(e *cacheEntry) error {
+	if strings.HasPrefix(e.Key, V1_LAYERS_DIR+":") {
+		os.Remove(e.Path + V1_INFO_EXT)
+	}
+	return os.Remove(e.Path)
+}
+
+//every cached entries, least recently used first
+func (c *blobCache) list() ([]*cacheEntry, error) {
+	var entries []*cacheEntry
+	algs, err := ioutil.ReadDir(c.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, alg := range algs {
+		if !alg.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(c.root, alg.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			name := fi.Name()
+			if fi.IsDir() || strings.HasSuffix(name, V1_INFO_EXT) || strings.Contains(name, CACHE_TMP_EXT) {
+				continue
+			}
+			entries = append(entries, &cacheEntry{
+				Key:     alg.Name() + ":" + name,
+				Path:    filepath.Join(c.root, alg.Name(), name),
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			})
+		}
+	}
+	sort.Sort(byModTime(entries))
+	return entries, nil
+}
+
+//check the content of an entry against its digest, the one recorded in their metadata for V1 layers
+func (c *blobCache) verify(e *cacheEntry) error {
+	dgst := e.Key
+	if alg := strings.SplitN(e.Key, ":", 2)[0]; alg == V1_LAYERS_DIR {
+		info, err := c.getV1Info(strings.TrimPrefix(e.Key, V1_LAYERS_DIR+":"))
+		if err == ErrCacheMiss {
+			return fmt.Errorf("missing layer metadata")
+		}
+		if err != nil {
+			return err
+		}
+		dgst = info.Digest
+	}
+
+	f, err := os.Open(e.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return verifyBlob(f, dgst)
+}
+
+//remove entries not used for maxAge (NO_AGE_LIMIT to ignore age), then least recently used entries until the
+//cache is smaller than maxSize (NO_SIZE_LIMIT to ignore size). Return removed entries
+func (c *blobCache) prune(maxAge time.Duration, maxSize int64) ([]*cacheEntry, error) {
+	entries, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+
+	var removed []*cacheEntry
+	for _, e := range entries {
+		tooOld := maxAge != NO_AGE_LIMIT && time.Since(e.ModTime) > maxAge
+		tooBig := maxSize != NO_SIZE_LIMIT && total > maxSize
+		if !tooOld && !tooBig {
+			continue
+		}
+		if err := c.remove(e); err != nil {
+			return removed, err
+		}
+		total -= e.Size
+		removed = append(removed, e)
+	}
+	return removed, nil
+}
+
+type byModTime []*cacheEntry
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime.Before(s[j].ModTime) }
+
+//krgo cache ls
+func listCache() error {
+	cache := newBlobCache()
+	entries, err := cache.list()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range entries {
+		printf("%s\t%.2f MB\tlast used %v\n", e.Key, float64(e.Size)/ONE_MB, e.ModTime.Format(time.RFC3339))
+		total += e.Size
+	}
+	printf("%d entries, %.2f MB in %v\n", len(entries), float64(total)/ONE_MB, cache.root)
+	return nil
+}
+
+//krgo cache verify, corrupted entries are removed
+func verifyCache() error {
+	cache := newBlobCache()
+	entries, err := cache.list()
+	if err != nil {
+		return err
+	}
+	corrupted := 0
+	for _, e := range entries {
+		printf("\t%s ... ", e.Key)
+		if err := cache.verify(e); err != nil {
+			printf("corrupted (%v), removing\n", err)
+			corrupted++
+			if err := cache.remove(e); err != nil {
+				return err
+			}
+			continue
+		}
+		printf("OK\n")
+	}
+	printf("%d entries verified, %d corrupted\n", len(entries), corrupted)
+	return nil
+}
+
+//krgo cache prune [--older-than age] [--max-size size]
+func pruneCache(maxAge time.Duration, maxSize int64) error {
+	removed, err := newBlobCache().prune(maxAge, maxSize)
+	var freed int64
+	for _, e := range removed {
+		printf("\tremoved %s\n", e.Key)
+		freed += e.Size
+	}
+	printf("%d entries removed, %.2f MB freed\n", len(removed), float64(freed)/ONE_MB)
+	return err
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const CACHE_TEST_PATH = "/tmp/krgo_cache"
+
+func TestBlobCache(t *testing.T) {
+	fmt.Printf("Testing blob cache ... ")
+	os.Setenv(KRGO_HOME_ENV, CACHE_TEST_PATH)
+	defer os.Unsetenv(KRGO_HOME_ENV)
+	defer os.RemoveAll(CACHE_TEST_PATH)
+	asserErrNil(os.MkdirAll(CACHE_TEST_PATH, 0700), t)
+
+	cache := newBlobCache()
+	if _, _, err := cache.get("sha256:abc"); err != ErrCacheMiss {
+		t.Fatalf("expected a cache miss got %v", err)
+	}
+	if _, err := cache.path("sha256:../../etc"); err == nil {
+		t.Fatal("expected keys with path separators to be rejected")
+	}
+
+	//add blobs
+	var keys []string
+	for i, content := range []string{"old layer", "recent layer", "newest layer"} {
+		dgst, err := computeDigest("sha256", []byte(content))
+		asserErrNil(err, t)
+		src := path.Join(CACHE_TEST_PATH, fmt.Sprintf("layer%d", i))
+		asserErrNil(ioutil.WriteFile(src, []byte(content), 0600), t)
+		asserErrNil(cache.put(dgst, src), t)
+		os.Remove(src)
+		p, _ := cache.path(dgst)
+		used := time.Now().Add(time.Duration(i-2) * 48 * time.Hour)
+		asserErrNil(os.Chtimes(p, used, used), t)
+		keys = append(keys, dgst)
+	}
+	v1Digest, err := computeDigest("sha256", []byte("v1 layer"))
+	asserErrNil(err, t)
+	asserErrNil(cache.putV1Info("1234", []byte("{}"), v1Digest), t)
+	asserErrNil(ioutil.WriteFile(path.Join(CACHE_TEST_PATH, "v1layer"), []byte("v1 layer"), 0600), t)
+	asserErrNil(cache.put(v1CacheKey("1234"), path.Join(CACHE_TEST_PATH, "v1layer")), t)
+	v1Path, _ := cache.path(v1CacheKey("1234"))
+	asserErrNil(os.Chtimes(v1Path, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)), t)
+
+	f, size, err := cache.get(keys[1])
+	asserErrNil(err, t)
+	content, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(content) != "recent layer" || size != int64(len(content)) {
+		t.Fatalf("unexpected cached content %q (%d bytes)", content, size)
+	}
+
+	entries, err := cache.list()
+	asserErrNil(err, t)
+	if len(entries) != 4 || entries[0].Key != keys[0] {
+		t.Fatalf("expected 4 entries, least recently used first, got %v", entries)
+	}
+	for _, e := range entries {
+		if err := cache.verify(e); err != nil {
+			t.Fatalf("%v: %v", e.Key, err)
+		}
+	}
+
+	//corrupted entries are detected
+	p, _ := cache.path(keys[2])
+	asserErrNil(ioutil.WriteFile(p, []byte("tampered"), 0600), t)
+	asserErrNil(os.Chtimes(p, time.Now().Add(time.Hour), time.Now().Add(time.Hour)), t)
+	if err := cache.verify(&cacheEntry{Key: keys[2], Path: p}); err == nil {
+		t.Fatal("expected a digest mismatch")
+	}
+
+	//prune by age then by size
+	removed, err := cache.prune(72*time.Hour, NO_SIZE_LIMIT)
+	asserErrNil(err, t)
+	if len(removed) != 1 || removed[0].Key != keys[0] {
+		t.Fatalf("expected %v to be pruned got %v", keys[0], removed)
+	}
+	removed, err = cache.prune(NO_AGE_LIMIT, 10)
+	asserErrNil(err, t)
+	if len(removed) != 2 {
+		t.Fatalf("expected 2 entries to be pruned got %d", len(removed))
+	}
+	entries, _ = cache.list()
+	if len(entries) != 1 || entries[0].Size > 10 {
+		t.Fatalf("expected a single entry under 10 bytes got %v", entries)
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestParseSizeAndAge(t *testing.T) {
+	fmt.Printf("Testing size and age parsing ... ")
+	sizes := map[string]int64{"512": 512, "1K": 1024, "10M": 10 << 20, "1.5G": 3 << 29, "2gb": 2 << 30}
+	for s, expected := range sizes {
+		size, err := parseSize(s)
+		asserErrNil(err, t)
+		if size != expected {
+			t.Fatalf("%v: expected %d got %d", s, expected, size)
+		}
+	}
+	for _, s := range []string{"", "M", "ten", "-1K"} {
+		if _, err := parseSize(s); err == nil {
+			t.Fatalf("expected %q to be an invalid size", s)
+		}
+	}
+
+	ages := map[string]time.Duration{"30d": 30 * 24 * time.Hour, "36h": 36 * time.Hour, "90m": 90 * time.Minute}
+	for s, expected := range ages {
+		age, err := parseAge(s)
+		asserErrNil(err, t)
+		if age != expected {
+			t.Fatalf("%v: expected %v got %v", s, expected, age)
+		}
+	}
+	if _, err := parseAge("soon"); err == nil {
+		t.Fatal("expected an invalid age")
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestPullingV2JobCache(t *testing.T) {
+	fmt.Printf("Testing layers from cache ... ")
+	os.Setenv(KRGO_HOME_ENV, CACHE_TEST_PATH)
+	defer os.Unsetenv(KRGO_HOME_ENV)
+	defer os.RemoveAll(CACHE_TEST_PATH)
+	asserErrNil(os.MkdirAll(CACHE_TEST_PATH, 0700), t)
+
+	cache := newBlobCache()
+	dgst, err := computeDigest("sha256", []byte("layer content"))
+	asserErrNil(err, t)
+	src := path.Join(CACHE_TEST_PATH, "layer")
+	asserErrNil(ioutil.WriteFile(src, []byte("layer content"), 0600), t)
+	asserErrNil(cache.put(dgst, src), t)
+
+	job := NewPullingV2Job(&registrySession{}, nil, nil, "busybox", dgst, 0)
+	job.fromCache(cache)
+	if !job.CacheHit || !job.Verified {
+		t.Fatal("expected a verified cache hit")
+	}
+	job.Close()
+
+	//corrupted entries are evicted, unless verification is skipped
+	p, _ := cache.path(dgst)
+	asserErrNil(ioutil.WriteFile(p, []byte("tampered"), 0600), t)
+	job = NewPullingV2Job(&registrySession{skipVerify: true}, nil, nil, "busybox", dgst, 0)
+	job.fromCache(cache)
+	if !job.CacheHit || job.Verified {
+		t.Fatal("expected an unverified cache hit")
+	}
+	job.Close()
+
+	job = NewPullingV2Job(&registrySession{}, nil, nil, "busybox", dgst, 0)
+	job.fromCache(cache)
+	if job.CacheHit {
+		t.Fatal("corrupted cache entry must not be used")
+	}
+	if fileExists(p) {
+		t.Fatal("corrupted cache entry must be evicted")
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestPullingJobCache(t *testing.T) {
+	fmt.Printf("Testing V1 layers from cache ... ")
+	os.Setenv(KRGO_HOME_ENV, CACHE_TEST_PATH)
+	defer os.Unsetenv(KRGO_HOME_ENV)
+	defer os.RemoveAll(CACHE_TEST_PATH)
+	asserErrNil(os.MkdirAll(CACHE_TEST_PATH, 0700), t)
+
+	cache := newBlobCache()
+	session := &registrySession{cache: cache}
+	dgst, err := computeDigest("sha256", []byte("v1 layer content"))
+	asserErrNil(err, t)
+	asserErrNil(cache.putV1Info("1234", []byte(`{"id":"1234"}`), dgst), t)
+	src := path.Join(CACHE_TEST_PATH, "layer")
+	asserErrNil(ioutil.WriteFile(src, []byte("v1 layer content"), 0600), t)
+	asserErrNil(cache.put(v1CacheKey("1234"), src), t)
+
+	job := NewPullingJob(session, nil, "1234")
+	if !job.fromCache() || string(job.LayerInfo) != `{"id":"1234"}` || job.LayerSize != len("v1 layer content") {
+		t.Fatalf("expected a cache hit got %s (%d bytes)", job.LayerInfo, job.LayerSize)
+	}
+	job.Close()
+
+	//truncated entries are evicted and downloaded again
+	p, _ := cache.path(v1CacheKey("1234"))
+	asserErrNil(ioutil.WriteFile(p, []byte("v1 layer"), 0600), t)
+	if job := NewPullingJob(session, nil, "1234"); job.fromCache() {
+		t.Fatal("corrupted cache entry must not be used")
+	}
+	if fileExists(p) || fileExists(p+V1_INFO_EXT) {
+		t.Fatal("corrupted cache entry must be evicted")
+	}
+
+	//entries cached without a digest can't be verified, they are downloaded again
+	asserErrNil(ioutil.WriteFile(p+V1_INFO_EXT, []byte(`{"id":"1234"}`), 0600), t)
+	asserErrNil(ioutil.WriteFile(p, []byte("v1 layer content"), 0600), t)
+	if job := NewPullingJob(session, nil, "1234"); job.fromCache() {
+		t.Fatal("entries without digest must not be used")
+	}
+	fmt.Printf("OK\n")
+}
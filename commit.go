@@ -15,22 +15,22 @@ import (
 
 //krgo commit -r rootfs
 //commit current changes in a new properly formated branch ready for pushing
-func commitChanges(rootfs, message string) error {
+func commitChanges(rootfs, message string) (*commitReport, error) {
 	if !isGitRepo(rootfs) {
-		return fmt.Errorf("%v not a git repository", rootfs)
+		return nil, fmt.Errorf("%v not a git repository", rootfs)
 	}
 	gitRepo, _ := newGitRepo(rootfs)
 
 	layerData, err := gitRepo.exportUncommitedChangeSet()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer layerData.Close()
 
 	//Load image data
 	image, err := image.LoadImage(gitRepo.Path) //reading json file in rootfs
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//fill new infos
@@ -41,37 +41,37 @@ func commitChanges(rootfs, message string) error {
 
 	layer, err := archive.NewTempArchive(layerData, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	image.Size = layer.Size
 	os.RemoveAll(layer.Name())
 
 	if err := image.SaveSize(rootfs); err != nil {
-		return err
+		return nil, err
 	}
 
 	jsonRaw, err := json.Marshal(image)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = ioutil.WriteFile(path.Join(rootfs, "json"), jsonRaw, 0600)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//commit the changes in a new branch
 	n, _ := gitRepo.countBranch()
 	br := newBranch(n, image.ID)
 	if _, err = gitRepo.checkoutB(br); err != nil {
-		return err
+		return nil, err
 	}
 	if _, err := gitRepo.addAllAndCommit(message); err != nil {
-		return err
+		return nil, err
 	}
 
-	fmt.Printf("Changes commited in %v\n", br)
-	fmt.Printf("Image ID: %v\nParent: %v\nChecksum: %v\nLayer size: %v\n", image.ID, image.Parent, image.Size)
+	printf("Changes commited in %v\n", br)
+	printf("Image ID: %v\nParent: %v\nChecksum: %v\nLayer size: %v\n", image.ID, image.Parent, image.Size)
 
-	return nil
+	return &commitReport{Branch: string(br), ImageID: image.ID, Parent: image.Parent, Size: image.Size}, nil
 }
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ENGINE_LXC          = "lxc"
+	ENGINE_LIBCONTAINER = "libcontainer"
+
+	LXC_INIT_SCRIPT = "/.krgo-init" //runs image commands lxc.init.cmd can't hold, written in the rootfs
+)
+
+//default file name of the generated config of each engine
+var engineConfigFiles = map[string]string{
+	ENGINE_LXC:          "lxc-config",
+	ENGINE_LIBCONTAINER: "container.json",
+}
+
+//generate the engine config of the image of rootfs and write it to dest (default: engine config file in
+//the rootfs parent directory)
+func generateConfig(engine, rootfs, dest string, tty bool) (string, error) {
+	fileName, ok := engineConfigFiles[engine]
+	if !ok {
+		return "", fmt.Errorf("unknown engine %q, expected %v or %v", engine, ENGINE_LXC, ENGINE_LIBCONTAINER)
+	}
+	img, err := readImageJSON(rootfs)
+	if err != nil {
+		return "", err
+	}
+	if img.OS != "" && img.OS != "linux" {
+		return "", fmt.Errorf("can't generate %v configs for %v images, only linux ones", engine, img.OS)
+	}
+	user, err := resolveUser(rootfs, img.Config.User)
+	if err != nil {
+		return "", err
+	}
+	absRootfs, err := filepath.Abs(rootfs)
+	if err != nil {
+		return "", err
+	}
+
+	var config []byte
+	if engine == ENGINE_LXC {
+		config, err = lxcConfig(img, user, absRootfs)
+	} else {
+		config, err = libcontainerConfig(img, user, absRootfs, tty)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if dest == "" {
+		dest = filepath.Join(filepath.Dir(rootfs), fileName)
+	}
+	return dest, ioutil.WriteFile(dest, config, 0644)
+}
+
+//lxc config running the image command, defaults are the ones of sample_configs/lxc-config. Keys are the
+//LXC >= 2.1 ones, LXC 3 rejects the legacy ones
+func lxcConfig(img *imageJSON, user *execUser, rootfs string) ([]byte, error) {
+	args, err := img.args()
+	if err != nil {
+		return nil, err
+	}
+	initCmd, err := lxcInitCmd(args, rootfs)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "# Generated by krgo %v\n\n", VERSION)
+	fmt.Fprintf(b, "# Container specific configuration\n")
+	fmt.Fprintf(b, "lxc.rootfs.path = %v\n", rootfs)
+	fmt.Fprintf(b, "lxc.uts.name = %v\n", DEFAULT_HOSTNAME)
+	if img.Architecture != "" {
+		fmt.Fprintf(b, "lxc.arch = %v\n", img.Architecture)
+	}
+
+	fmt.Fprintf(b, "\n# Image process\n")
+	fmt.Fprintf(b, "lxc.init.cmd = %v\n", initCmd)
+	fmt.Fprintf(b, "lxc.init.uid = %d\n", user.UID)
+	fmt.Fprintf(b, "lxc.init.gid = %d\n", user.GID)
+	fmt.Fprintf(b, "lxc.init.cwd = %v\n", img.workingDir())
+	for _, env := range img.env(user) {
+		fmt.Fprintf(b, "lxc.environment = %v\n", env)
+	}
+
+	if volumes := img.volumes(); len(volumes) > 0 {
+		fmt.Fprintf(b, "\n# Image volumes, uncomment and set the host directory to persist their data\n")
+		for _, v := range volumes {
+			fmt.Fprintf(b, "#lxc.mount.entry = /path/on/host %v none bind,create=dir 0 0\n", strings.TrimPrefix(v, "/"))
+		}
+	}
+
+	b.WriteString(lxcDefaults)
+	return b.Bytes(), nil
+}
+
+//lxc.init.cmd running args. LXC splits it on whitespace and doesn't handle quotes, commands it can't hold
+//(shell form ones mostly) are run by a /bin/sh script written in the rootfs
+func lxcInitCmd(args []string, rootfs string) (string, error) {
+	quoted := make([]string, len(args))
+	wrap := false
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\r\v\f'\"\\") {
+			wrap = true
+		}
+		quoted[i] = shellQuote(arg)
+	}
+	if !wrap {
+		return strings.Join(args, " "), nil
+	}
+
+	sh, err := pathInRootfs(rootfs, "/bin/sh")
+	if err != nil {
+		return "", err
+	}
+	if !fileExists(sh) {
+		return "", fmt.Errorf("lxc.init.cmd can't hold the image command %q and the image has no /bin/sh to run it from a script", args)
+	}
+	//resolved in the rootfs, a symlink can't make krgo write a host file
+	scriptPath, err := pathInRootfs(rootfs, LXC_INIT_SCRIPT)
+	if err != nil {
+		return "", err
+	}
+	script := "#!/bin/sh\n# Generated by krgo: the image command, lxc.init.cmd can't hold it\nexec " + strings.Join(quoted, " ") + "\n"
+	if err := ioutil.WriteFile(scriptPath, []byte(script), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(scriptPath, 0755); err != nil {
+		return "", err
+	}
+	printf("Image command written to %v in the rootfs, lxc.init.cmd runs it\n", LXC_INIT_SCRIPT)
+	return LXC_INIT_SCRIPT, nil
+}
+
+//single quote arg for sh
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'"'"'`, -1) + "'"
+}
+
+const lxcDefaults = `
+# Network configuration
+lxc.net.0.type = veth
+
+# Default mount entries
+lxc.mount.entry = proc proc proc nodev,noexec,nosuid 0 0
+lxc.mount.entry = sysfs sys sysfs defaults 0 0
+lxc.mount.entry = /sys/fs/fuse/connections sys/fs/fuse/connections none bind,optional 0 0
+lxc.mount.entry = /sys/kernel/debug sys/kernel/debug none bind,optional 0 0
+lxc.mount.entry = /sys/kernel/security sys/kernel/security none bind,optional 0 0
+lxc.mount.entry = /sys/fs/pstore sys/fs/pstore none bind,optional 0 0
+
+# Default console settings
+lxc.tty.dir = lxc
+lxc.tty.max = 4
+lxc.pty.max = 1024
+
+# Default capabilities
+lxc.cap.drop = sys_module mac_admin mac_override sys_time
+
+# Default cgroup limits
+lxc.cgroup.devices.deny = a
+## Allow any mknod (but not using the node)
+lxc.cgroup.devices.allow = c *:* m
+lxc.cgroup.devices.allow = b *:* m
+## /dev/null and zero
+lxc.cgroup.devices.allow = c 1:3 rwm
+lxc.cgroup.devices.allow = c 1:5 rwm
+## consoles
+lxc.cgroup.devices.allow = c 5:0 rwm
+lxc.cgroup.devices.allow = c 5:1 rwm
+## /dev/{,u}random
+lxc.cgroup.devices.allow = c 1:8 rwm
+lxc.cgroup.devices.allow = c 1:9 rwm
+## /dev/pts/*
+lxc.cgroup.devices.allow = c 5:2 rwm
+lxc.cgroup.devices.allow = c 136:* rwm
+## rtc
+lxc.cgroup.devices.allow = c 254:0 rm
+## fuse
+lxc.cgroup.devices.allow = c 10:229 rwm
+## tun
+lxc.cgroup.devices.allow = c 10:200 rwm
+## full
+lxc.cgroup.devices.allow = c 1:7 rwm
+## hpet
+lxc.cgroup.devices.allow = c 10:228 rwm
+## kvm
+lxc.cgroup.devices.allow = c 10:232 rwm
+
+# Blacklist some syscalls which are not safe in privileged
+# containers
+lxc.seccomp.profile = /usr/share/lxc/config/common.seccomp
+`
+
+//libcontainer (nsinit) container.json, only what krgo fills
+type libcontainerSpec struct {
+	Capabilities []string            `json:"capabilities"`
+	Cgroups      libcontainerCgroups `json:"cgroups"`
+	RestrictSys  bool                `json:"restrict_sys"`
+	MountConfig  libcontainerMounts  `json:"mount_config"`
+	Environment  []string            `json:"environment"`
+	Hostname     string              `json:"hostname"`
+	Namespaces   []libcontainerNs    `json:"namespaces"`
+	Tty          bool                `json:"tty"`
+	User         string              `json:"user"`
+	WorkingDir   string              `json:"working_dir"`
+	Rootfs       string              `json:"rootfs"`
+}
+
+type libcontainerCgroups struct {
+	AllowedDevices []libcontainerDevice `json:"allowed_devices"`
+	Name           string               `json:"name"`
+	Parent         string               `json:"parent"`
+}
+
+type libcontainerMounts struct {
+	DeviceNodes []libcontainerDevice `json:"device_nodes"`
+	Mounts      []libcontainerMount  `json:"mounts"`
+}
+
+type libcontainerMount struct {
+	Type        string `json:"type"`
+	Destination string `json:"destination"`
+}
+
+type libcontainerNs struct {
+	Type string `json:"type"`
+}
+
+type libcontainerDevice struct {
+	CgroupPermissions string `json:"cgroup_permissions"`
+	FileMode          uint32 `json:"file_mode,omitempty"`
+	MajorNumber       int64  `json:"major_number"`
+	MinorNumber       int64  `json:"minor_number"`
+	Path              string `json:"path,omitempty"`
+	Type              rune   `json:"type"`
+}
+
+//device nodes created in the container, as in sample_configs/container.json
+var libcontainerDeviceNodes = []libcontainerDevice{
+	{CgroupPermissions: "rwm", FileMode: 0666, MajorNumber: 1, MinorNumber: 3, Path: "/dev/null", Type: 'c'},
+	{CgroupPermissions: "rwm", FileMode: 0666, MajorNumber: 1, MinorNumber: 5, Path: "/dev/zero", Type: 'c'},
+	{CgroupPermissions: "rwm", FileMode: 0666, MajorNumber: 1, MinorNumber: 7, Path: "/dev/full", Type: 'c'},
+	{CgroupPermissions: "rwm", FileMode: 0666, MajorNumber: 5, MinorNumber: 0, Path: "/dev/tty", Type: 'c'},
+	{CgroupPermissions: "rwm", FileMode: 0666, MajorNumber: 1, MinorNumber: 9, Path: "/dev/urandom", Type: 'c'},
+	{CgroupPermissions: "rwm", FileMode: 0666, MajorNumber: 1, MinorNumber: 8, Path: "/dev/random", Type: 'c'},
+}
+
+//devices the container may use besides its device nodes
+var libcontainerAllowedDevices = []libcontainerDevice{
+	{CgroupPermissions: "m", MajorNumber: -1, MinorNumber: -1, Type: 'c'},
+	{CgroupPermissions: "m", MajorNumber: -1, MinorNumber: -1, Type: 'b'},
+	{CgroupPermissions: "rwm", MajorNumber: 5, MinorNumber: 1, Path: "/dev/console", Type: 'c'},
+	{CgroupPermissions: "rwm", MajorNumber: 4, MinorNumber: 0, Path: "/dev/tty0", Type: 'c'},
+	{CgroupPermissions: "rwm", MajorNumber: 4, MinorNumber: 1, Path: "/dev/tty1", Type: 'c'},
+	{CgroupPermissions: "rwm", MajorNumber: 136, MinorNumber: -1, Type: 'c'},
+	{CgroupPermissions: "rwm", MajorNumber: 5, MinorNumber: 2, Type: 'c'},
+	{CgroupPermissions: "rwm", MajorNumber: 10, MinorNumber: 200, Type: 'c'},
+}
+
+//libcontainer container.json of the image, defaults are the ones of sample_configs/container.json.
+//nsinit takes the command to run on its command line, it is printed
+func libcontainerConfig(img *imageJSON, user *execUser, rootfs string, tty bool) ([]byte, error) {
+	args, err := img.args()
+	if err != nil {
+		return nil, err
+	}
+	env := append(img.env(user), "HOSTNAME="+DEFAULT_HOSTNAME)
+	if tty && !hasEnv(env, "TERM") {
+		env = append(env, "TERM=xterm")
+	}
+	if volumes := img.volumes(); len(volumes) > 0 {
+		printf("Image declares volumes %v, add bind mounts to the mount_config of container.json to persist their data\n", strings.Join(volumes, ", "))
+	}
+	printf("Command of the image: %v\n", strings.Join(args, " "))
+
+	spec := &libcontainerSpec{
+		Capabilities: []string{
+			"CHOWN", "DAC_OVERRIDE", "FOWNER", "MKNOD", "NET_RAW", "SETGID", "SETUID",
+			"SETFCAP", "SETPCAP", "NET_BIND_SERVICE", "SYS_CHROOT", "KILL",
+		},
+		Cgroups: libcontainerCgroups{
+			AllowedDevices: append(append([]libcontainerDevice{}, libcontainerAllowedDevices...), libcontainerDeviceNodes...),
+			Name:           "krgo-" + filepath.Base(rootfs),
+			Parent:         "krgo",
+		},
+		RestrictSys: true,
+		MountConfig: libcontainerMounts{
+			DeviceNodes: libcontainerDeviceNodes,
+			Mounts:      []libcontainerMount{{Type: "tmpfs", Destination: "/tmp"}},
+		},
+		Environment: env,
+		Hostname:    DEFAULT_HOSTNAME,
+		Namespaces:  []libcontainerNs{{"NEWIPC"}, {"NEWNS"}, {"NEWPID"}, {"NEWUTS"}},
+		Tty:         tty,
+		User:        fmt.Sprintf("%d:%d", user.UID, user.GID),
+		WorkingDir:  img.workingDir(),
+		Rootfs:      rootfs,
+	}
+	config, err := json.MarshalIndent(spec, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return append(config, '\n'), nil
+}
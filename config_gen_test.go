@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenerateLXCConfig(t *testing.T) {
+	fmt.Printf("Testing lxc config generation ... ")
+	rootfs := writeTestRootfs(t, `{"Env": ["FOO=bar"], "Cmd": ["sh", "-c", "echo it's up"], "User": "www", "Volumes": {"/data": {}}}`)
+	defer os.RemoveAll(path.Dir(rootfs))
+	asserErrNil(os.MkdirAll(path.Join(rootfs, "bin"), 0755), t)
+	asserErrNil(ioutil.WriteFile(path.Join(rootfs, "bin", "sh"), nil, 0755), t)
+
+	configPath, err := generateConfig(ENGINE_LXC, rootfs, "", false)
+	asserErrNil(err, t)
+	if configPath != path.Join(path.Dir(rootfs), "lxc-config") {
+		t.Fatalf("unexpected config path %v", configPath)
+	}
+	raw, err := ioutil.ReadFile(configPath)
+	asserErrNil(err, t)
+	config := string(raw)
+	absRootfs, _ := filepath.Abs(rootfs)
+	for _, line := range []string{
+		"lxc.rootfs.path = " + absRootfs,
+		"lxc.uts.name = " + DEFAULT_HOSTNAME,
+		"lxc.init.cmd = " + LXC_INIT_SCRIPT,
+		"lxc.init.uid = 33",
+		"lxc.init.gid = 33",
+		"lxc.init.cwd = /",
+		"lxc.environment = FOO=bar",
+		"lxc.environment = " + DEFAULT_PATH_ENV,
+		"lxc.environment = HOME=/var/www",
+		"#lxc.mount.entry = /path/on/host data none bind,create=dir 0 0",
+		"lxc.cap.drop = sys_module mac_admin mac_override sys_time",
+	} {
+		if !strings.Contains(config, line+"\n") {
+			t.Fatalf("expected %q in config:\n%v", line, config)
+		}
+	}
+
+	//legacy keys are rejected by LXC 3
+	for _, key := range []string{"lxc.rootfs =", "lxc.utsname", "lxc.init_", "lxc.network.", "lxc.pivotdir", "lxc.tty =", "lxc.pts", "lxc.seccomp ="} {
+		if strings.Contains(config, key) {
+			t.Fatalf("unexpected legacy key %v in config:\n%v", key, config)
+		}
+	}
+
+	//lxc.init.cmd is split on whitespace, the shell form command is run by a script
+	script, err := ioutil.ReadFile(path.Join(rootfs, LXC_INIT_SCRIPT))
+	asserErrNil(err, t)
+	if expected := "exec 'sh' '-c' 'echo it'\"'\"'s up'\n"; !strings.HasSuffix(string(script), expected) {
+		t.Fatalf("expected script to end with %q got %q", expected, script)
+	}
+
+	//commands lxc.init.cmd can hold are run directly
+	asserErrNil(os.Remove(path.Join(rootfs, LXC_INIT_SCRIPT)), t)
+	asserErrNil(ioutil.WriteFile(path.Join(rootfs, "json"), []byte(`{"config": {"Cmd": ["/bin/app", "--port=80"]}}`), 0644), t)
+	_, err = generateConfig(ENGINE_LXC, rootfs, "", false)
+	asserErrNil(err, t)
+	raw, err = ioutil.ReadFile(configPath)
+	asserErrNil(err, t)
+	if !strings.Contains(string(raw), "lxc.init.cmd = /bin/app --port=80\n") || fileExists(path.Join(rootfs, LXC_INIT_SCRIPT)) {
+		t.Fatalf("expected the command in lxc.init.cmd, got:\n%s", raw)
+	}
+
+	//no shell to run the script
+	asserErrNil(os.Remove(path.Join(rootfs, "bin", "sh")), t)
+	asserErrNil(ioutil.WriteFile(path.Join(rootfs, "json"), []byte(`{"config": {"Cmd": ["echo", ""]}}`), 0644), t)
+	if _, err := generateConfig(ENGINE_LXC, rootfs, "", false); err == nil {
+		t.Fatalf("expected a command needing a script to fail without /bin/sh")
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestGenerateLibcontainerConfig(t *testing.T) {
+	fmt.Printf("Testing libcontainer config generation ... ")
+	rootfs := writeTestRootfs(t, `{"Env": ["HOME=/home"], "Entrypoint": ["/bin/app"], "WorkingDir": "/srv", "User": "1000:staff"}`)
+	defer os.RemoveAll(path.Dir(rootfs))
+	dest := path.Join(path.Dir(rootfs), "nsinit.json")
+
+	configPath, err := generateConfig(ENGINE_LIBCONTAINER, rootfs, dest, true)
+	asserErrNil(err, t)
+	if configPath != dest {
+		t.Fatalf("expected config in %v got %v", dest, configPath)
+	}
+	raw, err := ioutil.ReadFile(configPath)
+	asserErrNil(err, t)
+	spec := &libcontainerSpec{}
+	asserErrNil(json.Unmarshal(raw, spec), t)
+
+	expectedEnv := []string{"HOME=/home", DEFAULT_PATH_ENV, "HOSTNAME=" + DEFAULT_HOSTNAME, "TERM=xterm"}
+	if !reflect.DeepEqual(spec.Environment, expectedEnv) {
+		t.Fatalf("expected env %v got %v", expectedEnv, spec.Environment)
+	}
+	if spec.User != "1000:50" || spec.WorkingDir != "/srv" || spec.Hostname != DEFAULT_HOSTNAME || !spec.Tty {
+		t.Fatalf("unexpected config %+v", spec)
+	}
+	if len(spec.MountConfig.DeviceNodes) == 0 || spec.MountConfig.DeviceNodes[0].Type != 'c' || spec.MountConfig.DeviceNodes[0].FileMode != 438 {
+		t.Fatalf("unexpected device nodes %+v", spec.MountConfig.DeviceNodes)
+	}
+
+	if _, err := generateConfig("docker", rootfs, "", false); err == nil {
+		t.Fatalf("expected unknown engine to fail")
+	}
+	fmt.Printf("OK\n")
+}
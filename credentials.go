@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/registry"
+)
+
+const (
+	DOCKER_CONFIG_ENV     = "DOCKER_CONFIG"
+	DOCKER_CONFIG_FILE    = "config.json"
+	DOCKER_LEGACY_CFG     = ".dockercfg"
+	CRED_HELPER_PREFIX    = "docker-credential-"
+	CRED_HELPER_NOT_FOUND = "credentials not found in native keychain"
+)
+
+var ErrCredentialsNotFound = fmt.Errorf("credentials not found")
+
+//docker client configuration, only credentials related entries are kept
+type dockerConfigFile struct {
+	Auths       map[string]dockerAuthEntry `json:"auths"`
+	CredsStore  string                     `json:"credsStore,omitempty"`
+	CredHelpers map[string]string          `json:"credHelpers,omitempty"`
+
+	filename string
+}
+
+type dockerAuthEntry struct {
+	Auth  string `json:"auth"`
+	Email string `json:"email,omitempty"`
+}
+
+//directory of the docker client config, $DOCKER_CONFIG or ~/.docker
+func dockerConfigDir() string {
+	if dir := os.Getenv(DOCKER_CONFIG_ENV); dir != "" {
+		return dir
+	}
+	return path.Join(os.Getenv("HOME"), ".docker")
+}
+
+//load ~/.docker/config.json falling back on the legacy ~/.dockercfg. An empty config is returned if none exist
+func loadDockerConfig() (*dockerConfigFile, error) {
+	configFile := &dockerConfigFile{Auths: make(map[string]dockerAuthEntry), filename: path.Join(dockerConfigDir(), DOCKER_CONFIG_FILE)}
+
+	b, err := ioutil.ReadFile(configFile.filename)
+	if err == nil {
+		if err := json.Unmarshal(b, configFile); err != nil {
+			return nil, fmt.Errorf("invalid docker config %v: %v", configFile.filename, err)
+		}
+		if configFile.Auths == nil {
+			configFile.Auths = make(map[string]dockerAuthEntry)
+		}
+		return configFile, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	//legacy format: auths entries at the root of the file
+	legacyFilename := path.Join(os.Getenv("HOME"), DOCKER_LEGACY_CFG)
+	b, err = ioutil.ReadFile(legacyFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return configFile, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &configFile.Auths); err != nil {
+		return nil, fmt.Errorf("invalid docker config %v: %v", legacyFilename, err)
+	}
+	return configFile, nil
+}
+
+//credential helper configured for registryHost, if any
+func (cf *dockerConfigFile) credentialHelper(registryHost string) credentialHelper {
+	for key, helper := range cf.CredHelpers {
+		if normalizeRegistryKey(key) == normalizeRegistryKey(registryHost) {
+			return credentialHelper(helper)
+		}
+	}
+	return credentialHelper(cf.CredsStore)
+}
+
+//decode the auths entry of registryHost
+func (cf *dockerConfigFile) authConfig(registryHost string) (*registry.AuthConfig, error) {
+	for key, entry := range cf.Auths {
+		if normalizeRegistryKey(key) != normalizeRegistryKey(registryHost) {
+			continue
+		}
+		authConfig, err := decodeAuth(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth entry for %v in %v: %v", key, cf.filename, err)
+		}
+		authConfig.Email = entry.Email
+		authConfig.ServerAddress = key
+		return authConfig, nil
+	}
+	return nil, ErrCredentialsNotFound
+}
+
+//auth format: base64(<username>:<password>)
+func decodeAuth(auth string) (*registry.AuthConfig, error) {
+	b, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return nil, err
+	}
+	userName, password := parseCredentials(string(b))
+	if userName == "" {
+		return nil, fmt.Errorf("expected username:password")
+	}
+	return &registry.AuthConfig{Username: userName, Password: password, Auth: auth}, nil
+}
+
+func encodeAuth(userName, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(userName + ":" + password))
+}
+
+//config keys may be registry hosts or full URLs (https://index.docker.io/v1/), compare them by host
+func normalizeRegistryKey(key string) string {
+	key = strings.TrimPrefix(key, "https://")
+	key = strings.TrimPrefix(key, "http://")
+	key = strings.SplitN(key, "/", 2)[0]
+	if isDockerHub(key) {
+		return registry.INDEXNAME
+	}
+	return key
+}
+
+//server address credentials are stored under, docker uses the index URL for the docker hub
+func credentialsServerAddress(registryHost string) string {
+	if isDockerHub(registryHost) {
+		return registry.INDEXSERVER
+	}
+	return registryHost
+}
+
+//resolve credentials of registryHost the way docker does: credential helper first, config file entries then
+func resolveCredentials(registryHost string) (*registry.AuthConfig, error) {
+	configFile, err := loadDockerConfig()
+	if err != nil {
+		return nil, err
+	}
+	if helper := configFile.credentialHelper(registryHost); helper != "" {
+		return helper.get(credentialsServerAddress(registryHost))
+	}
+	return configFile.authConfig(registryHost)
+}
+
+//docker-credential-<helper> executable, speaking JSON over stdin/stdout
+type credentialHelper string
+
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func (h credentialHelper) get(serverAddress string) (*registry.AuthConfig, error) {
+	out, err := h.exec("get", []byte(serverAddress))
+	if err != nil {
+		if _, ok := err.(*exec.Error); ok {
+			//helper not installed, like docker, go on without credentials
+			printf("WARNING: credential helper %v%v not available (%v), continuing without credentials\n", CRED_HELPER_PREFIX, h, err)
+			return nil, ErrCredentialsNotFound
+		}
+		if strings.Contains(err.Error(), CRED_HELPER_NOT_FOUND) {
+			return nil, ErrCredentialsNotFound
+		}
+		return nil, err
+	}
+	var creds helperCredentials
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return nil, fmt.Errorf("invalid %v%v output: %v", CRED_HELPER_PREFIX, h, err)
+	}
+	return &registry.AuthConfig{Username: creds.Username, Password: creds.Secret, ServerAddress: serverAddress}, nil
+}
+
+func (h credentialHelper) store(authConfig *registry.AuthConfig) error {
+	b, err := json.Marshal(helperCredentials{ServerURL: authConfig.ServerAddress, Username: authConfig.Username, Secret: authConfig.Password})
+	if err != nil {
+		return err
+	}
+	_, err = h.exec("store", b)
+	return err
+}
+
+func (h credentialHelper) erase(serverAddress string) error {
+	_, err := h.exec("erase", []byte(serverAddress))
+	return err
+}
+
+func (h credentialHelper) exec(action string, input []byte) ([]byte, error) {
+	helperPath, err := exec.LookPath(CRED_HELPER_PREFIX + string(h))
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(helperPath, action)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("%v%v %v: %v (%v)", CRED_HELPER_PREFIX, h, action, strings.TrimSpace(string(out)+stderr.String()), err)
+	}
+	return out, nil
+}
+
+//store credentials of registryHost, using the configured credential helper if any,
+//the config file otherwise
+func storeCredentials(registryHost string, authConfig *registry.AuthConfig) error {
+	configFile, err := loadDockerConfig()
+	if err != nil {
+		return err
+	}
+	authConfig.ServerAddress = credentialsServerAddress(registryHost)
+	if helper := configFile.credentialHelper(registryHost); helper != "" {
+		return helper.store(authConfig)
+	}
+	configFile.removeAuth(registryHost)
+	configFile.Auths[authConfig.ServerAddress] = dockerAuthEntry{Auth: encodeAuth(authConfig.Username, authConfig.Password), Email: authConfig.Email}
+	return configFile.save()
+}
+
+//erase credentials of registryHost from the credential helper or the config file
+func eraseCredentials(registryHost string) error {
+	configFile, err := loadDockerConfig()
+	if err != nil {
+		return err
+	}
+	if helper := configFile.credentialHelper(registryHost); helper != "" {
+		return helper.erase(credentialsServerAddress(registryHost))
+	}
+	if !configFile.removeAuth(registryHost) {
+		return ErrCredentialsNotFound
+	}
+	return configFile.save()
+}
+
+//remove every auths entry matching registryHost, return whether one was found
+func (cf *dockerConfigFile) removeAuth(registryHost string) bool {
+	found := false
+	for key := range cf.Auths {
+		if normalizeRegistryKey(key) == normalizeRegistryKey(registryHost) {
+			delete(cf.Auths, key)
+			found = true
+		}
+	}
+	return found
+}
+
+//write auths entries into config.json (0600) keeping every other entry of the file untouched
+func (cf *dockerConfigFile) save() error {
+	raw := make(map[string]json.RawMessage)
+	if b, err := ioutil.ReadFile(cf.filename); err == nil {
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return fmt.Errorf("invalid docker config %v: %v", cf.filename, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	auths, err := json.Marshal(cf.Auths)
+	if err != nil {
+		return err
+	}
+	raw["auths"] = auths
+
+	b, err := json.MarshalIndent(raw, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(cf.filename), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cf.filename, b, 0600); err != nil {
+		return err
+	}
+	//WriteFile doesn't change permissions of an existing file
+	return os.Chmod(cf.filename, 0600)
+}
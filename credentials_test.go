@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/registry"
+)
+
+const CREDS_TEST_PATH = "/tmp/krgo_creds"
+
+//fake credential helper storing a single entry in a file
+const fakeCredHelper = `#!/bin/sh
+store=` + CREDS_TEST_PATH + `/helper_store
+case "$1" in
+	get) if [ -f $store ]; then cat $store; else echo "credentials not found in native keychain"; exit 1; fi ;;
+	store) cat > $store ;;
+	erase) rm -f $store ;;
+esac
+`
+
+func TestDockerConfigCredentials(t *testing.T) {
+	fmt.Printf("Testing docker config credentials ... ")
+	asserErrNil(os.MkdirAll(CREDS_TEST_PATH, 0700), t)
+	defer os.RemoveAll(CREDS_TEST_PATH)
+	defer os.Setenv(DOCKER_CONFIG_ENV, os.Getenv(DOCKER_CONFIG_ENV))
+	os.Setenv(DOCKER_CONFIG_ENV, CREDS_TEST_PATH)
+
+	config := fmt.Sprintf(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "%s"},
+		"registry.local:5000": {"auth": "%s", "email": "bob@krgo.com"}
+	}}`, encodeAuth("hubuser", "hubpass"), encodeAuth("bob", "p:ss"))
+	asserErrNil(ioutil.WriteFile(path.Join(CREDS_TEST_PATH, DOCKER_CONFIG_FILE), []byte(config), 0600), t)
+
+	expected := map[string][2]string{
+		"":                    {"hubuser", "hubpass"},
+		"docker.io":           {"hubuser", "hubpass"},
+		"registry.local:5000": {"bob", "p:ss"},
+	}
+	for host, creds := range expected {
+		authConfig, err := resolveCredentials(host)
+		asserErrNil(err, t)
+		if authConfig.Username != creds[0] || authConfig.Password != creds[1] {
+			t.Fatalf("%v: got %v:%v expected %v:%v", host, authConfig.Username, authConfig.Password, creds[0], creds[1])
+		}
+	}
+
+	if _, err := resolveCredentials("other.registry"); err != ErrCredentialsNotFound {
+		t.Fatalf("expected %v got %v", ErrCredentialsNotFound, err)
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestCredentialHelper(t *testing.T) {
+	fmt.Printf("Testing credential helper ... ")
+	asserErrNil(os.MkdirAll(CREDS_TEST_PATH, 0700), t)
+	defer os.RemoveAll(CREDS_TEST_PATH)
+	asserErrNil(ioutil.WriteFile(path.Join(CREDS_TEST_PATH, CRED_HELPER_PREFIX+"fake"), []byte(fakeCredHelper), 0700), t)
+
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", CREDS_TEST_PATH+":"+os.Getenv("PATH"))
+	defer os.Setenv(DOCKER_CONFIG_ENV, os.Getenv(DOCKER_CONFIG_ENV))
+	os.Setenv(DOCKER_CONFIG_ENV, CREDS_TEST_PATH)
+	asserErrNil(ioutil.WriteFile(path.Join(CREDS_TEST_PATH, DOCKER_CONFIG_FILE), []byte(`{"credHelpers": {"registry.local:5000": "fake"}}`), 0600), t)
+
+	if _, err := resolveCredentials("registry.local:5000"); err != ErrCredentialsNotFound {
+		t.Fatalf("expected %v got %v", ErrCredentialsNotFound, err)
+	}
+
+	helper := credentialHelper("fake")
+	asserErrNil(helper.store(&registry.AuthConfig{Username: "bob", Password: "secret", ServerAddress: "registry.local:5000"}), t)
+
+	authConfig, err := resolveCredentials("registry.local:5000")
+	asserErrNil(err, t)
+	if authConfig.Username != "bob" || authConfig.Password != "secret" {
+		t.Fatalf("got %v:%v expected bob:secret", authConfig.Username, authConfig.Password)
+	}
+
+	asserErrNil(helper.erase("registry.local:5000"), t)
+	if _, err := resolveCredentials("registry.local:5000"); err != ErrCredentialsNotFound {
+		t.Fatalf("expected %v got %v", ErrCredentialsNotFound, err)
+	}
+
+	//missing helper binary: anonymous access, but storing credentials fails
+	asserErrNil(ioutil.WriteFile(path.Join(CREDS_TEST_PATH, DOCKER_CONFIG_FILE), []byte(`{"credHelpers": {"registry.local:5000": "missing"}}`), 0600), t)
+	if _, err := resolveCredentials("registry.local:5000"); err != ErrCredentialsNotFound {
+		t.Fatalf("expected %v got %v", ErrCredentialsNotFound, err)
+	}
+	if err := credentialHelper("missing").store(&registry.AuthConfig{Username: "bob", Password: "secret"}); err == nil {
+		t.Fatal("expected storing with a missing helper to fail")
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestStoreCredentials(t *testing.T) {
+	fmt.Printf("Testing credentials store ... ")
+	asserErrNil(os.MkdirAll(CREDS_TEST_PATH, 0700), t)
+	defer os.RemoveAll(CREDS_TEST_PATH)
+	defer os.Setenv(DOCKER_CONFIG_ENV, os.Getenv(DOCKER_CONFIG_ENV))
+	os.Setenv(DOCKER_CONFIG_ENV, path.Join(CREDS_TEST_PATH, "docker"))
+
+	configPath := path.Join(CREDS_TEST_PATH, "docker", DOCKER_CONFIG_FILE)
+	asserErrNil(storeCredentials("registry.local:5000", &registry.AuthConfig{Username: "bob", Password: "secret"}), t)
+
+	info, err := os.Stat(configPath)
+	asserErrNil(err, t)
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected config permissions 0600 got %v", info.Mode().Perm())
+	}
+
+	//other config entries must survive
+	config, err := ioutil.ReadFile(configPath)
+	asserErrNil(err, t)
+	config = append([]byte(`{"psFormat": "table",`), config[1:]...)
+	asserErrNil(ioutil.WriteFile(configPath, config, 0644), t)
+
+	asserErrNil(storeCredentials("", &registry.AuthConfig{Username: "hubuser", Password: "hubpass"}), t)
+	authConfig, err := resolveCredentials("registry.local:5000")
+	asserErrNil(err, t)
+	if authConfig.Username != "bob" || authConfig.Password != "secret" {
+		t.Fatalf("got %v:%v expected bob:secret", authConfig.Username, authConfig.Password)
+	}
+
+	asserErrNil(eraseCredentials("registry.local:5000"), t)
+	if _, err := resolveCredentials("registry.local:5000"); err != ErrCredentialsNotFound {
+		t.Fatalf("expected %v got %v", ErrCredentialsNotFound, err)
+	}
+	if _, err := resolveCredentials("docker.io"); err != nil {
+		t.Fatal(err)
+	}
+	if err := eraseCredentials("registry.local:5000"); err != ErrCredentialsNotFound {
+		t.Fatalf("expected %v got %v", ErrCredentialsNotFound, err)
+	}
+
+	config, err = ioutil.ReadFile(configPath)
+	asserErrNil(err, t)
+	info, _ = os.Stat(configPath)
+	if !strings.Contains(string(config), "psFormat") || info.Mode().Perm() != 0600 {
+		t.Fatalf("config file not properly saved: %s (%v)", config, info.Mode().Perm())
+	}
+	fmt.Printf("OK\n")
+}
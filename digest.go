@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/docker/pkg/tarsum"
+)
+
+var ErrDigestMismatch = fmt.Errorf("content doesn't match the expected digest")
+
+//return whether reference is a content digest (<algorithm>:<hex>) rather than a tag
+func isDigest(reference string) bool {
+	return digestRegexp.MatchString(reference)
+}
+
+//hash of content using dgst algorithm, formatted as a digest
+func computeDigest(algorithm string, content []byte) (string, error) {
+	h, err := newDigestHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	h.Write(content)
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func newDigestHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported digest algorithm %v", algorithm)
+}
+
+//hash what's read through it: tarsum for tarsum digests, plain hash otherwise
+type layerSumReader interface {
+	io.Reader
+	Sum([]byte) string
+}
+
+func newLayerSumReader(r io.Reader, sumStr string) (layerSumReader, error) {
+	algorithm := strings.SplitN(sumStr, ":", 2)[0]
+	if strings.HasPrefix(algorithm, "tarsum") {
+		return tarsum.NewTarSumForLabel(r, true, algorithm)
+	}
+	return newDigestReader(r, algorithm)
+}
+
+//sha256 digest of the content of r, r is rewound
+func fileDigest(r io.ReadSeeker) (string, error) {
+	dr, err := newDigestReader(r, "sha256")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, 0); err != nil {
+		return "", err
+	}
+	return dr.Sum(nil), nil
+}
+
+//verify that the blob read from r matches sumStr (tarsum or content digest), r is rewound afterward
+func verifyBlob(r io.ReadSeeker, sumStr string) error {
+	sr, err := newLayerSumReader(r, sumStr)
+	if err != nil {
+		return err
+	}
+	//the whole blob must go through the digester (compressed streams may have trailing data)
+	if _, err := io.Copy(ioutil.Discard, sr); err != nil {
+		return err
+	}
+	if computed := sr.Sum(nil); !strings.EqualFold(computed, sumStr) {
+		return digestMismatchError(sumStr, computed)
+	}
+	_, err = r.Seek(0, 0)
+	return err
+}
+
+//verify that rawManifest hashes to dgst. Signed schema1 manifests are addressed by the digest of their
+//payload (the manifest without its signatures), so both are tried
+func verifyManifestDigest(rawManifest []byte, dgst string) error {
+	algorithm := strings.SplitN(dgst, ":", 2)[0]
+
+	candidates := [][]byte{rawManifest}
+	if payload, err := signedManifestPayload(rawManifest); err == nil {
+		candidates = append(candidates, payload)
+	}
+
+	var computed string
+	for _, content := range candidates {
+		var err error
+		if computed, err = computeDigest(algorithm, content); err != nil {
+			return err
+		}
+		if strings.EqualFold(computed, dgst) {
+			return nil
+		}
+	}
+	return digestMismatchError(dgst, computed)
+}
+
+//digest a registry addresses rawManifest by: sha256 of the payload for signed schema1 manifests, of the
+//manifest itself otherwise
+func manifestDigest(rawManifest []byte) (string, error) {
+	if payload, err := signedManifestPayload(rawManifest); err == nil {
+		rawManifest = payload
+	}
+	return computeDigest("sha256", rawManifest)
+}
+
+//libtrust JWS protected header, tells how to rebuild the signed payload from the signed manifest
+type jsProtectedHeader struct {
+	FormatLength int    `json:"formatLength"`
+	FormatTail   string `json:"formatTail"`
+}
+
+//extract the payload of a libtrust signed manifest: the formatLength first bytes followed by formatTail
+func signedManifestPayload(rawManifest []byte) ([]byte, error) {
+	var signed struct {
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(rawManifest, &signed); err != nil {
+		return nil, err
+	}
+	if len(signed.Signatures) == 0 {
+		return nil, fmt.Errorf("manifest is not signed")
+	}
+
+	protectedBytes, err := joseBase64UrlDecode(signed.Signatures[0].Protected)
+	if err != nil {
+		return nil, err
+	}
+	var protected jsProtectedHeader
+	if err := json.Unmarshal(protectedBytes, &protected); err != nil {
+		return nil, err
+	}
+	if protected.FormatLength < 0 || protected.FormatLength > len(rawManifest) {
+		return nil, fmt.Errorf("invalid signature format length %d", protected.FormatLength)
+	}
+	tail, err := joseBase64UrlDecode(protected.FormatTail)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, 0, protected.FormatLength+len(tail))
+	payload = append(payload, rawManifest[:protected.FormatLength]...)
+	return append(payload, tail...), nil
+}
+
+//base64 url encoding without padding, as used by JOSE
+func joseBase64UrlDecode(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	switch len(s) % 4 {
+	case 2:
+		s += "=="
+	case 3:
+		s += "="
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+//reader computing the digest of what's read through it
+type digestReader struct {
+	io.Reader
+	algorithm string
+	hash      hash.Hash
+}
+
+func newDigestReader(r io.Reader, algorithm string) (*digestReader, error) {
+	h, err := newDigestHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &digestReader{Reader: io.TeeReader(r, h), algorithm: algorithm, hash: h}, nil
+}
+
+//digest of the content read so far, extra is appended like tarsum does
+func (dr *digestReader) Sum(extra []byte) string {
+	if extra != nil {
+		dr.hash.Write(extra)
+	}
+	return dr.algorithm + ":" + hex.EncodeToString(dr.hash.Sum(nil))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+//build a manifest signed the libtrust way: signatures are inserted before the payload format tail
+func fakeSignManifest(payload string) string {
+	formatLength := strings.LastIndex(payload, "\n}")
+	protected := fmt.Sprintf(`{"formatLength":%d,"formatTail":"%s"}`, formatLength, base64.URLEncoding.EncodeToString([]byte("\n}")))
+	signatures := fmt.Sprintf(`,
+   "signatures": [{"protected": "%s"}]`, strings.TrimRight(base64.URLEncoding.EncodeToString([]byte(protected)), "="))
+	return payload[:formatLength] + signatures + "\n}"
+}
+
+func TestVerifyManifestDigest(t *testing.T) {
+	fmt.Printf("Testing manifest digest verification ... ")
+	payload := "{\n   \"name\": \"library/busybox\",\n   \"schemaVersion\": 1\n}"
+	signed := fakeSignManifest(payload)
+
+	payloadDigest, err := computeDigest("sha256", []byte(payload))
+	asserErrNil(err, t)
+	signedDigest, err := computeDigest("sha256", []byte(signed))
+	asserErrNil(err, t)
+
+	asserErrNil(verifyManifestDigest([]byte(payload), payloadDigest), t)
+	asserErrNil(verifyManifestDigest([]byte(signed), payloadDigest), t)
+	asserErrNil(verifyManifestDigest([]byte(signed), signedDigest), t)
+
+	if err := verifyManifestDigest([]byte(payload), signedDigest); err == nil {
+		t.Fatal("expected a digest mismatch")
+	}
+	if err := verifyManifestDigest([]byte(payload), "md5:"+strings.Repeat("0", 32)); err == nil {
+		t.Fatal("expected an unsupported algorithm error")
+	}
+
+	//signed manifests are addressed by their payload digest
+	if dgst, err := manifestDigest([]byte(signed)); err != nil || dgst != payloadDigest {
+		t.Fatalf("expected digest %v got %v (%v)", payloadDigest, dgst, err)
+	}
+	if dgst, err := manifestDigest([]byte(payload)); err != nil || dgst != payloadDigest {
+		t.Fatalf("expected digest %v got %v (%v)", payloadDigest, dgst, err)
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestVerifyBlob(t *testing.T) {
+	fmt.Printf("Testing blob verification ... ")
+	content := []byte("layer content")
+	dgst, err := computeDigest("sha256", content)
+	asserErrNil(err, t)
+
+	r := bytes.NewReader(content)
+	asserErrNil(verifyBlob(r, dgst), t)
+	//rewound so it can be applied
+	if read, _ := ioutil.ReadAll(r); !bytes.Equal(read, content) {
+		t.Fatal("blob not rewound after verification")
+	}
+
+	//registries may send uppercase hex digests
+	asserErrNil(verifyBlob(bytes.NewReader(content), "sha256:"+strings.ToUpper(strings.TrimPrefix(dgst, "sha256:"))), t)
+
+	err = verifyBlob(bytes.NewReader([]byte("tampered content")), dgst)
+	if err == nil || !strings.Contains(err.Error(), ErrDigestMismatch.Error()) {
+		t.Fatalf("expected a digest mismatch got %v", err)
+	}
+	if err := verifyBlob(r, "md5:abcd"); err == nil {
+		t.Fatal("expected an unsupported algorithm error")
+	}
+	fmt.Printf("OK\n")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	PARTIAL_DIR       = "partial"
+	PARTIAL_LOCK_POLL = 100 * time.Millisecond
+)
+
+//fetch content starting at offset. partial tells whether the content really starts at offset (range honored)
+//or at the beginning
+type rangeFetcher func(ctx context.Context, offset int64) (body io.ReadCloser, partial bool, err error)
+
+//directory partial downloads are kept in, so they can be resumed on retry or on a later pull
+func partialDir() string {
+	return path.Join(krgoHome(), PARTIAL_DIR)
+}
+
+//download content into a partial file named after key, resuming it if it already exists. Once complete the
+//content is verified against expectedSize and expectedDigest (when known and not a tarsum) and returned
+//positioned at its beginning, the file is removed once closed.
+//If the download fails the partial file is kept for the next attempt
+func resumableDownload(ctx context.Context, key string, expectedSize int64, expectedDigest string, fetch rangeFetcher) (*spooledFile, int64, error) {
+	if err := os.MkdirAll(partialDir(), 0700); err != nil {
+		return nil, 0, err
+	}
+	partialPath := path.Join(partialDir(), strings.Replace(key, ":", "_", -1)+".partial")
+	f, err := lockPartialFile(ctx, partialPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	spooled := &spooledFile{File: f}
+
+	size, err := downloadInto(ctx, f, expectedSize, fetch)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	if err := verifyDownload(f, size, expectedSize, expectedDigest); err != nil {
+		//corrupted content, start over next time
+		spooled.Close()
+		return nil, 0, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		spooled.Close()
+		return nil, 0, err
+	}
+	return spooled, size, nil
+}
+
+//open the partial file at partialPath and lock it exclusively, so concurrent pulls sharing a layer don't write
+//into the same file. The lock is released when the file is closed
+func lockPartialFile(ctx context.Context, partialPath string) (*os.File, error) {
+	waiting := false
+	for {
+		f, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err != syscall.EWOULDBLOCK {
+				break
+			}
+			if !waiting {
+				printf("\twaiting for another download of %v\n", strings.TrimSuffix(path.Base(partialPath), ".partial"))
+				waiting = true
+			}
+			select {
+			case <-ctx.Done():
+				f.Close()
+				return nil, ctx.Err()
+			case <-time.After(PARTIAL_LOCK_POLL):
+			}
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		//the previous owner may have completed and removed the file meanwhile, lock the new one then
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(partialPath); err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		f.Close()
+	}
+}
+
+//append what's missing to f, return the size of the content
+func downloadInto(ctx context.Context, f *os.File, expectedSize int64, fetch rangeFetcher) (int64, error) {
+	offset, err := f.Seek(0, 2)
+	if err != nil {
+		return 0, err
+	}
+	if expectedSize > 0 && offset > expectedSize {
+		offset = 0
+	}
+	if expectedSize > 0 && offset == expectedSize {
+		if progress := progressFrom(ctx); progress != nil {
+			progress.set(offset)
+		}
+		return offset, nil
+	}
+
+	body, partial, err := fetch(ctx, offset)
+	if offset > 0 && errorStatusCode(err) == http.StatusRequestedRangeNotSatisfiable {
+		//the partial file holds the whole content already or more (unknown expected size): start over
+		offset = 0
+		body, partial, err = fetch(ctx, offset)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	if offset > 0 && partial {
+		printf("\tresuming %v at %d bytes\n", path.Base(f.Name()), offset)
+	} else {
+		offset = 0
+	}
+	if progress := progressFrom(ctx); progress != nil {
+		progress.set(offset)
+	}
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, 0); err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, &ctxReader{ctx, body})
+	return offset + n, err
+}
+
+func verifyDownload(f *os.File, size, expectedSize int64, expectedDigest string) error {
+	if expectedSize > 0 && size != expectedSize {
+		return withExitCode(EXIT_VERIFICATION, fmt.Errorf("downloaded %d bytes, expected %d", size, expectedSize))
+	}
+	//tarsums are calculated on the tar content, they are verified when the layer is applied
+	if expectedDigest == "" || strings.HasPrefix(expectedDigest, "tarsum") {
+		return nil
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	dr, err := newDigestReader(f, strings.SplitN(expectedDigest, ":", 2)[0])
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+		return err
+	}
+	if computed := dr.Sum(nil); computed != expectedDigest {
+		return digestMismatchError(expectedDigest, computed)
+	}
+	return nil
+}
+
+//Range header value to fetch content from offset
+func rangeHeader(offset int64) string {
+	return fmt.Sprintf("bytes=%d-", offset)
+}
+
+//whether a response to a range request actually is partial content
+func isPartialResponse(res *http.Response) bool {
+	return res.StatusCode == http.StatusPartialContent
+}
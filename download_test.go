@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const DOWNLOAD_TEST_PATH = "/tmp/krgo_download"
+
+//serve content from offset, failing after failAfter bytes if failAfter > 0
+func rangeServer(content []byte, failAfter int) rangeFetcher {
+	return func(ctx context.Context, offset int64) (io.ReadCloser, bool, error) {
+		data := content[offset:]
+		var r io.Reader = bytes.NewReader(data)
+		if failAfter > 0 && failAfter < len(data) {
+			r = io.MultiReader(bytes.NewReader(data[:failAfter]), &failingReader{})
+		}
+		return ioutil.NopCloser(r), offset > 0, nil
+	}
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestResumableDownload(t *testing.T) {
+	fmt.Printf("Testing resumable download ... ")
+	os.Setenv(KRGO_HOME_ENV, DOWNLOAD_TEST_PATH)
+	defer os.Unsetenv(KRGO_HOME_ENV)
+	defer os.RemoveAll(DOWNLOAD_TEST_PATH)
+
+	content := bytes.Repeat([]byte("krgo"), 1000)
+	dgst, err := computeDigest("sha256", content)
+	asserErrNil(err, t)
+	size := int64(len(content))
+
+	//first attempt fails midway, partial content is kept
+	_, _, err = resumableDownload(context.Background(), dgst, size, dgst, rangeServer(content, 1500))
+	if err == nil {
+		t.Fatal("expected the first attempt to fail")
+	}
+
+	//second attempt only fetches what's missing
+	var offsets []int64
+	fetch := func(ctx context.Context, offset int64) (io.ReadCloser, bool, error) {
+		offsets = append(offsets, offset)
+		return rangeServer(content, 0)(ctx, offset)
+	}
+	f, n, err := resumableDownload(context.Background(), dgst, size, dgst, fetch)
+	asserErrNil(err, t)
+	if len(offsets) != 1 || offsets[0] != 1500 {
+		t.Fatalf("expected download to resume at 1500, got %v", offsets)
+	}
+	if n != size {
+		t.Fatalf("expected %d bytes got %d", size, n)
+	}
+	got, err := ioutil.ReadAll(f)
+	asserErrNil(err, t)
+	if !bytes.Equal(got, content) {
+		t.Fatal("resumed content differs from the original")
+	}
+	f.Close()
+	if fileExists(f.Name()) {
+		t.Fatalf("%v should have been removed once closed", f.Name())
+	}
+
+	//corrupted partial content is detected and discarded
+	_, _, err = resumableDownload(context.Background(), dgst, size, dgst, rangeServer(bytes.Repeat([]byte("oops"), 1000), 0))
+	if err == nil {
+		t.Fatal("expected a digest mismatch")
+	}
+	f, _, err = resumableDownload(context.Background(), dgst, size, dgst, rangeServer(content, 0))
+	asserErrNil(err, t)
+	f.Close()
+
+	//servers ignoring the range request start over
+	if _, _, err = resumableDownload(context.Background(), dgst, size, dgst, rangeServer(content, 1500)); err == nil {
+		t.Fatal("expected the download to fail")
+	}
+	ignoreRange := func(ctx context.Context, offset int64) (io.ReadCloser, bool, error) {
+		return ioutil.NopCloser(bytes.NewReader(content)), false, nil
+	}
+	f, _, err = resumableDownload(context.Background(), dgst, size, dgst, ignoreRange)
+	asserErrNil(err, t)
+	f.Close()
+
+	//complete partial file of unknown size (schema1 blob): the registry rejects the range, the download starts over
+	asserErrNil(ioutil.WriteFile(path.Join(partialDir(), "unsized.partial"), content, 0600), t)
+	offsets = nil
+	rejectRange := func(ctx context.Context, offset int64) (io.ReadCloser, bool, error) {
+		offsets = append(offsets, offset)
+		if offset >= size {
+			return nil, false, &httpStatusError{StatusCode: http.StatusRequestedRangeNotSatisfiable, Message: "error fetching blob"}
+		}
+		return rangeServer(content, 0)(ctx, offset)
+	}
+	f, n, err = resumableDownload(context.Background(), "unsized", 0, dgst, rejectRange)
+	asserErrNil(err, t)
+	f.Close()
+	if n != size || len(offsets) != 2 || offsets[1] != 0 {
+		t.Fatalf("expected the download to start over after a 416, got %d bytes, offsets %v", n, offsets)
+	}
+
+	fmt.Printf("OK\n")
+}
+
+func TestPartialFileLock(t *testing.T) {
+	fmt.Printf("Testing partial download lock ... ")
+	os.Setenv(KRGO_HOME_ENV, DOWNLOAD_TEST_PATH)
+	defer os.Unsetenv(KRGO_HOME_ENV)
+	defer os.RemoveAll(DOWNLOAD_TEST_PATH)
+	asserErrNil(os.MkdirAll(partialDir(), 0700), t)
+
+	content := bytes.Repeat([]byte("krgo"), 1000)
+	dgst, err := computeDigest("sha256", content)
+	asserErrNil(err, t)
+
+	//another pull is downloading the layer
+	other, err := lockPartialFile(context.Background(), path.Join(partialDir(), "shared.partial"))
+	asserErrNil(err, t)
+	other.Write(content[:1500])
+
+	fetched := make(chan int64, 1)
+	done := make(chan error, 1)
+	go func() {
+		f, _, err := resumableDownload(context.Background(), "shared", int64(len(content)), dgst, func(ctx context.Context, offset int64) (io.ReadCloser, bool, error) {
+			fetched <- offset
+			return rangeServer(content, 0)(ctx, offset)
+		})
+		if err == nil {
+			f.Close()
+		}
+		done <- err
+	}()
+	select {
+	case <-fetched:
+		t.Fatal("expected the download to wait for the partial file lock")
+	case <-time.After(3 * PARTIAL_LOCK_POLL):
+	}
+
+	//once released, the download resumes what the other pull fetched
+	other.Close()
+	asserErrNil(<-done, t)
+	if offset := <-fetched; offset != 1500 {
+		t.Fatalf("expected the download to resume at 1500 got %d", offset)
+	}
+
+	//a waiting download doesn't keep a partial file removed by its previous owner
+	other, err = lockPartialFile(context.Background(), path.Join(partialDir(), "removed.partial"))
+	asserErrNil(err, t)
+	locked := make(chan *os.File, 1)
+	go func() {
+		f, err := lockPartialFile(context.Background(), path.Join(partialDir(), "removed.partial"))
+		if err != nil {
+			f = nil
+		}
+		locked <- f
+	}()
+	time.Sleep(2 * PARTIAL_LOCK_POLL)
+	spooled := &spooledFile{File: other}
+	spooled.Close()
+	f := <-locked
+	if f == nil {
+		t.Fatal("expected the partial file to be locked")
+	}
+	defer f.Close()
+
+	//closing the previous owner again (like aborted pulls release every downloaded layer) leaves the new file alone
+	spooled.Close()
+	if current, err := os.Stat(f.Name()); err != nil {
+		t.Fatalf("expected a new partial file: %v", err)
+	} else if fi, _ := f.Stat(); !os.SameFile(fi, current) {
+		t.Fatal("expected the lock to be taken on the new partial file")
+	}
+	fmt.Printf("OK\n")
+}
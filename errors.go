@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//exit codes of krgo, one per kind of failure
+const (
+	EXIT_FAILURE      = 1 //any other failure
+	EXIT_AUTH         = 2 //authentication failed or access denied
+	EXIT_NOT_FOUND    = 3 //repository, tag or layer not found
+	EXIT_RATE_LIMITED = 4 //the registry throttled krgo
+	EXIT_VERIFICATION = 5 //digest or signature verification failed
+	EXIT_GIT_DIRTY    = 6 //rootfs has uncommitted changes
+	EXIT_NETWORK      = 7 //registry unreachable
+)
+
+//max number of tags suggested when a tag isn't found
+const MAX_TAG_SUGGESTIONS = 20
+
+var errorKinds = map[int]string{
+	EXIT_FAILURE:      "failure",
+	EXIT_AUTH:         "auth",
+	EXIT_NOT_FOUND:    "not_found",
+	EXIT_RATE_LIMITED: "rate_limited",
+	EXIT_VERIFICATION: "verification",
+	EXIT_GIT_DIRTY:    "git_dirty",
+	EXIT_NETWORK:      "network",
+}
+
+//failure of a known kind, krgo exits with ExitCode
+type krgoError struct {
+	ExitCode int
+	Err      error
+	Cause    error //error Err was formatted from, if any
+}
+
+func withExitCode(code int, err error) error {
+	return &krgoError{ExitCode: code, Err: err}
+}
+
+//format an error message about err, keeping its kind
+func wrapError(err error, format string, a ...interface{}) error {
+	return &krgoError{ExitCode: exitCode(err), Err: fmt.Errorf(format, a...), Cause: err}
+}
+
+func (err *krgoError) Error() string {
+	return err.Err.Error()
+}
+
+//exit code of err: the one of typed errors, guessed from the HTTP status or the error type otherwise
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case *krgoError:
+		return e.ExitCode
+	case net.Error: //includes *url.Error returned by HTTP clients
+		return EXIT_NETWORK
+	}
+	switch errorStatusCode(err) {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return EXIT_AUTH
+	case http.StatusNotFound:
+		return EXIT_NOT_FOUND
+	case http.StatusTooManyRequests:
+		return EXIT_RATE_LIMITED
+	}
+	return EXIT_FAILURE
+}
+
+func errorKind(code int) string {
+	if kind, ok := errorKinds[code]; ok {
+		return kind
+	}
+	return errorKinds[EXIT_FAILURE]
+}
+
+func digestMismatchError(expected, computed string) error {
+	return withExitCode(EXIT_VERIFICATION, fmt.Errorf("%v: expected %v got %v", ErrDigestMismatch, expected, computed))
+}
+
+//tag not found in imageName, suggesting the tags the repository has
+func tagNotFoundError(imageName, tag string, tags []string) error {
+	msg := fmt.Sprintf("tag %v not found in %v", tag, imageName)
+	if len(tags) == 0 {
+		return withExitCode(EXIT_NOT_FOUND, fmt.Errorf("%v (the repository has no tags)", msg))
+	}
+	tags = append([]string(nil), tags...)
+	sort.Strings(tags)
+	suggested := tags
+	if len(suggested) > MAX_TAG_SUGGESTIONS {
+		suggested = suggested[:MAX_TAG_SUGGESTIONS]
+	}
+	msg = fmt.Sprintf("%v, available tags: %v", msg, strings.Join(suggested, ", "))
+	if len(tags) > len(suggested) {
+		msg = fmt.Sprintf("%v ... (%d more)", msg, len(tags)-len(suggested))
+	}
+	return withExitCode(EXIT_NOT_FOUND, fmt.Errorf("%s", msg))
+}
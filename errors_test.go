@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+func TestExitCode(t *testing.T) {
+	fmt.Printf("Testing error exit codes ... ")
+	cases := map[error]int{
+		fmt.Errorf("boom"):                                                     EXIT_FAILURE,
+		&httpStatusError{StatusCode: 401}:                                      EXIT_AUTH,
+		&jsonmessage.JSONError{Code: 403}:                                      EXIT_AUTH,
+		&httpStatusError{StatusCode: 404}:                                      EXIT_NOT_FOUND,
+		&httpStatusError{StatusCode: 429}:                                      EXIT_RATE_LIMITED,
+		&httpStatusError{StatusCode: 500}:                                      EXIT_FAILURE,
+		digestMismatchError("sha256:aa", "sha256:bb"):                          EXIT_VERIFICATION,
+		ErrManifestUnsigned:                                                    EXIT_VERIFICATION,
+		&url.Error{Op: "Get", URL: "https://x", Err: &net.OpError{Op: "dial"}}: EXIT_NETWORK,
+	}
+	for err, code := range cases {
+		if c := exitCode(err); c != code {
+			t.Fatalf("%#v: expected exit code %d got %d", err, code, c)
+		}
+	}
+
+	//wrapping keeps the kind, and the status code for retries
+	wrapped := wrapError(&httpStatusError{StatusCode: 404}, "layer %v: not there", "abc")
+	if exitCode(wrapped) != EXIT_NOT_FOUND || isRetryable(wrapped) || wrapped.Error() != "layer abc: not there" {
+		t.Fatalf("unexpected wrapped error %v (exit code %d)", wrapped, exitCode(wrapped))
+	}
+	if errorKind(EXIT_GIT_DIRTY) != "git_dirty" || errorKind(42) != "failure" {
+		t.Fatal("unexpected error kinds")
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestTagNotFoundError(t *testing.T) {
+	fmt.Printf("Testing tag not found suggestions ... ")
+	err := tagNotFoundError("library/busybox", "lastest", []string{"latest", "1.0", "buildroot"})
+	if exitCode(err) != EXIT_NOT_FOUND || err.Error() != "tag lastest not found in library/busybox, available tags: 1.0, buildroot, latest" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var tags []string
+	for i := 0; i < MAX_TAG_SUGGESTIONS+5; i++ {
+		tags = append(tags, fmt.Sprintf("v%02d", i))
+	}
+	if err := tagNotFoundError("app", "v99", tags); !strings.HasSuffix(err.Error(), "v19 ... (5 more)") {
+		t.Fatalf("expected suggestions to be truncated got %v", err)
+	}
+	if err := tagNotFoundError("app", "latest", nil); !strings.Contains(err.Error(), "no tags") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	fmt.Printf("OK\n")
+}
@@ -93,6 +93,12 @@ func (r *gitRepo) commit(message string) ([]byte, error) {
 	return r.execInWorkTree("commit", "-m", message)
 }
 
+//return whether the work tree has uncommitted changes
+func (r *gitRepo) isDirty() (bool, error) {
+	out, err := r.execInWorkTree("status", "--porcelain")
+	return len(out) > 0, err
+}
+
 func (r *gitRepo) branch() ([]branch, error) {
 	b, err := r.execInWorkTree("branch")
 	if err != nil {
@@ -120,6 +126,11 @@ func (r *gitRepo) branchDescription(br branch) ([]byte, error) {
 	return r.execInWorkTree("config", "branch."+br.string()+".description")
 }
 
+//content of file as commited in br
+func (r *gitRepo) showFile(br branch, file string) ([]byte, error) {
+	return r.execInWorkTree("show", br.string()+":"+file)
+}
+
 func (r *gitRepo) countBranch() (int, error) {
 	branches, err := r.branch()
 	if err != nil {
@@ -129,11 +140,69 @@ func (r *gitRepo) countBranch() (int, error) {
 }
 
 func (r *gitRepo) diffCached() ([]byte, error) {
-	return r.execInWorkTree("diff", "--cached", "--name-status")
+	return r.execInWorkTree("diff", "--cached", "--name-status", "--no-renames")
 }
 
 func (r *gitRepo) diff(br1, br2 branch) ([]byte, error) {
-	return r.execInWorkTree("diff", br1.string()+".."+br2.string(), "--name-status")
+	//renames would be reported as a single line, exports need the deletion and the addition
+	return r.execInWorkTree("diff", br1.string()+".."+br2.string(), "--name-status", "--no-renames")
+}
+
+//state of a git layered rootfs, restored when a pull into it fails
+type gitRestorePoint struct {
+	repo     *gitRepo
+	head     string //branch checked out, commit if detached
+	branches map[branch]bool
+}
+
+//restore point of the git repository of rootfs, nil if rootfs isn't a git repository or has no commit yet.
+//Uncommitted changes couldn't be restored, the work tree must be clean
+func newGitRestorePoint(rootfs string) (*gitRestorePoint, error) {
+	if !isGitRepo(rootfs) {
+		return nil, nil
+	}
+	r := &gitRepo{Path: rootfs}
+	commit, err := r.execInWorkTree("rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return nil, nil
+	}
+	if err := checkCommitted(r); err != nil {
+		return nil, err
+	}
+	p := &gitRestorePoint{repo: r, head: strings.TrimSpace(string(commit)), branches: make(map[branch]bool)}
+	if br, err := r.currentBranch(); err == nil {
+		p.head = br.string()
+	}
+	branches, err := r.branch()
+	if err != nil {
+		return nil, err
+	}
+	for _, br := range branches {
+		p.branches[br] = true
+	}
+	return p, nil
+}
+
+//check the restore point head out back, dropping what was written since and the branches created since
+func (p *gitRestorePoint) restore() error {
+	if _, err := p.repo.execInWorkTree("checkout", "-f", p.head); err != nil {
+		return err
+	}
+	if _, err := p.repo.execInWorkTree("clean", "-fd"); err != nil {
+		return err
+	}
+	branches, err := p.repo.branch()
+	if err != nil {
+		return err
+	}
+	for _, br := range branches {
+		if !p.branches[br] {
+			if _, err := p.repo.execInWorkTree("branch", "-D", br.string()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 //export every uncommited changes in the current branch
@@ -147,6 +216,8 @@ func (r *gitRepo) exportUncommitedChangeSet() (archive.Archive, error) {
 	return exportChanges(r.Path, diff)
 }
 
+//export the changes br brings to its parent. The work tree stays on br until the returned archive, read lazily,
+//is closed
 func (r *gitRepo) exportChangeSet(br branch) (archive.Archive, error) {
 	currentBr, err := r.currentBranch()
 	if err != nil {
@@ -158,15 +229,19 @@ func (r *gitRepo) exportChangeSet(br branch) (archive.Archive, error) {
 		return nil, err
 	}
 
-	defer func() {
-		r.checkout(currentBr)
-	}()
-
-	branches, err := r.branch()
+	layerData, err := r.exportBranchChanges(br)
 	if err != nil {
+		r.checkout(currentBr)
 		return nil, err
 	}
+	return &checkedOutArchive{Archive: layerData, restore: func() error {
+		_, err := r.checkout(currentBr)
+		return err
+	}}, nil
+}
 
+//export the changes of br, checked out
+func (r *gitRepo) exportBranchChanges(br branch) (archive.Archive, error) {
 	switch br.number() {
 	case 0:
 		changes, err := archive.ChangesDirs(r.Path, "")
@@ -181,12 +256,46 @@ func (r *gitRepo) exportChangeSet(br branch) (archive.Archive, error) {
 		}
 		return archive.ExportChanges(r.Path, curatedChanges)
 	default:
-		parentBr := branches[br.number()-1]
-		diff, _ := r.diff(parentBr, br)
+		parentBr, err := r.layerBranch(br.number() - 1)
+		if err != nil {
+			return nil, err
+		}
+		diff, err := r.diff(parentBr, br)
+		if err != nil {
+			return nil, err
+		}
 		return exportChanges(r.Path, diff)
 	}
 }
 
+//branch of the nth layer. git lists branches alphabetically (layer_1, layer_10, layer_2 ...), not by layer
+func (r *gitRepo) layerBranch(n int) (branch, error) {
+	branches, err := r.branch()
+	if err != nil {
+		return "", err
+	}
+	for _, br := range branches {
+		if br.number() == n {
+			return br, nil
+		}
+	}
+	return "", fmt.Errorf("missing git layer branch layer_%d", n)
+}
+
+//archive reading the files of a checked out branch, the previous branch is checked out back on close
+type checkedOutArchive struct {
+	archive.Archive
+	restore func() error
+}
+
+func (a *checkedOutArchive) Close() error {
+	err := a.Archive.Close()
+	if restoreErr := a.restore(); restoreErr != nil {
+		return restoreErr
+	}
+	return err
+}
+
 func exportChanges(rootfs string, diff []byte) (archive.Archive, error) {
 	var changes []archive.Change
 
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -84,6 +86,192 @@ func TestGitFlow(t *testing.T) {
 	fmt.Printf("OK\n")
 }
 
+//git layered image like pulls create: a.txt is added in layer 0, modified in layer 1 and deleted in layer 2
+func newTestLayeredRepo(repoPath string, t *testing.T) *gitRepo {
+	return newTestRepo(repoPath, []func(){
+		func() {
+			asserErrNil(ioutil.WriteFile(path.Join(repoPath, "a.txt"), []byte("layer 0"), 0644), t)
+			asserErrNil(ioutil.WriteFile(path.Join(repoPath, "keep.txt"), []byte("layer 0"), 0644), t)
+		},
+		func() { asserErrNil(ioutil.WriteFile(path.Join(repoPath, "a.txt"), []byte("layer 1"), 0644), t) },
+		func() {
+			asserErrNil(os.Remove(path.Join(repoPath, "a.txt")), t)
+			asserErrNil(ioutil.WriteFile(path.Join(repoPath, "b.txt"), []byte("layer 2"), 0644), t)
+		},
+	}, t)
+}
+
+//git layered image of n layers: layer i sets count.txt and adds f<i>.txt. With more than 10 layers,
+//git lists the branches out of layer order
+func newTestManyLayersRepo(repoPath string, n int, t *testing.T) *gitRepo {
+	var steps []func()
+	for i := 0; i < n; i++ {
+		content := []byte("layer " + strconv.Itoa(i))
+		file := "f" + strconv.Itoa(i) + ".txt"
+		steps = append(steps, func() {
+			asserErrNil(ioutil.WriteFile(path.Join(repoPath, "count.txt"), content, 0644), t)
+			asserErrNil(ioutil.WriteFile(path.Join(repoPath, file), content, 0644), t)
+		})
+	}
+	return newTestRepo(repoPath, steps, t)
+}
+
+//files of layer i of newTestManyLayersRepo, and the ones of the other layers that must not be in it
+func manyLayersFiles(i, n int) (map[string]string, []string) {
+	content := "layer " + strconv.Itoa(i)
+	files := map[string]string{"count.txt": content, "f" + strconv.Itoa(i) + ".txt": content}
+	var unexpected []string
+	for j := 0; j < n; j++ {
+		if j != i {
+			unexpected = append(unexpected, "f"+strconv.Itoa(j)+".txt")
+		}
+	}
+	return files, unexpected
+}
+
+//git layered image with a layer branch (and its json) per step
+func newTestRepo(repoPath string, steps []func(), t *testing.T) *gitRepo {
+	r, err := newGitRepo(repoPath)
+	asserErrNil(err, t)
+	parent := ""
+	for i, step := range steps {
+		id := fmt.Sprintf("%064d", i+1)
+		_, err := r.checkoutB(newBranch(i, id))
+		asserErrNil(err, t)
+		step()
+		jsonRaw, err := json.Marshal(newV1Compat(id, parent))
+		asserErrNil(err, t)
+		asserErrNil(ioutil.WriteFile(path.Join(repoPath, "json"), jsonRaw, 0644), t)
+		parent = id
+		_, err = r.addAllAndCommit("layer " + strconv.Itoa(i))
+		asserErrNil(err, t)
+	}
+	return r
+}
+
+//layer branches of r, base layer first
+func layerBranches(r *gitRepo, t *testing.T) []branch {
+	brs, err := r.branch()
+	asserErrNil(err, t)
+	sorted := make([]branch, len(brs))
+	for _, br := range brs {
+		sorted[br.number()] = br
+	}
+	return sorted
+}
+
+func TestExportChangeSetLayers(t *testing.T) {
+	fmt.Printf("Testing git layers export ... ")
+	repoPath := "/tmp/git_repo_layers"
+	r := newTestLayeredRepo(repoPath, t)
+	defer os.RemoveAll(repoPath)
+	brs, err := r.branch()
+	asserErrNil(err, t)
+
+	//files are read from the exported branch, not from the checked out one
+	tests := []struct {
+		files      map[string]string
+		unexpected []string
+	}{
+		{map[string]string{"a.txt": "layer 0", "keep.txt": "layer 0"}, []string{"b.txt"}},
+		{map[string]string{"a.txt": "layer 1"}, []string{"keep.txt", "b.txt"}},
+		{map[string]string{"b.txt": "layer 2", ".wh.a.txt": ""}, []string{"a.txt", "keep.txt"}},
+	}
+	for i, test := range tests {
+		tar, err := r.exportChangeSet(brs[i])
+		asserErrNil(err, t)
+		tarShouldContain(tar, test.files, test.unexpected, t)
+		asserErrNil(tar.Close(), t)
+
+		//the previous branch is checked out back once the archive is closed
+		if br, _ := r.currentBranch(); br != brs[2] {
+			t.Fatalf("expected %v checked out got %v", brs[2], br)
+		}
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestExportChangeSetManyLayers(t *testing.T) {
+	fmt.Printf("Testing git layers export with more than 10 layers ... ")
+	repoPath := "/tmp/git_repo_many_layers"
+	r := newTestManyLayersRepo(repoPath, 12, t)
+	defer os.RemoveAll(repoPath)
+
+	//each layer is diffed against the layer below it, not against the branch git lists before it
+	brs := layerBranches(r, t)
+	for i, br := range brs {
+		tar, err := r.exportChangeSet(br)
+		asserErrNil(err, t)
+		files, unexpected := manyLayersFiles(i, len(brs))
+		tarShouldContain(tar, files, unexpected, t)
+		asserErrNil(tar.Close(), t)
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestGitRestorePoint(t *testing.T) {
+	fmt.Printf("Testing git restore point ... ")
+	repoPath := "/tmp/git_repo_restore"
+	r := newTestLayeredRepo(repoPath, t)
+	defer os.RemoveAll(repoPath)
+	brs := layerBranches(r, t)
+
+	p, err := newGitRestorePoint(repoPath)
+	asserErrNil(err, t)
+	if p == nil || p.head != brs[2].string() {
+		t.Fatalf("expected a restore point on %v got %+v", brs[2], p)
+	}
+
+	//a failed pull created a layer and was applying the next one
+	_, err = r.checkoutB(newBranch(3, fmt.Sprintf("%064d", 4)))
+	asserErrNil(err, t)
+	asserErrNil(ioutil.WriteFile(path.Join(repoPath, "pulled.txt"), []byte("layer 3"), 0644), t)
+	_, err = r.addAllAndCommit("layer 3")
+	asserErrNil(err, t)
+	_, err = r.checkoutB(newBranch(4, fmt.Sprintf("%064d", 5)))
+	asserErrNil(err, t)
+	asserErrNil(ioutil.WriteFile(path.Join(repoPath, "partial.txt"), []byte("layer 4"), 0644), t)
+	asserErrNil(ioutil.WriteFile(path.Join(repoPath, "keep.txt"), []byte("layer 4"), 0644), t)
+
+	asserErrNil(p.restore(), t)
+	if current, _ := r.currentBranch(); current != brs[2] {
+		t.Fatalf("expected %v checked out got %v", brs[2], current)
+	}
+	if after := layerBranches(r, t); len(after) != 3 {
+		t.Fatalf("expected the pulled branches to be deleted got %v", after)
+	}
+	filesShouldExist(false, []string{"pulled.txt", "partial.txt"}, repoPath, t)
+	if keep, _ := ioutil.ReadFile(path.Join(repoPath, "keep.txt")); string(keep) != "layer 0" {
+		t.Fatalf("expected keep.txt to be reset got %q", keep)
+	}
+
+	//uncommitted changes couldn't be restored
+	asserErrNil(ioutil.WriteFile(path.Join(repoPath, "keep.txt"), []byte("changed"), 0644), t)
+	if _, err := newGitRestorePoint(repoPath); exitCode(err) != EXIT_GIT_DIRTY {
+		t.Fatalf("expected a dirty repository error got %v", err)
+	}
+	if p, err := newGitRestorePoint("/tmp"); p != nil || err != nil {
+		t.Fatalf("expected no restore point outside git repositories got %v %v", p, err)
+	}
+	fmt.Printf("OK\n")
+}
+
+//check the files of a layer tar and their content
+func tarShouldContain(tar io.Reader, files map[string]string, unexpectedFiles []string, t *testing.T) {
+	dir, err := ioutil.TempDir("", "krgo_test_tar_")
+	asserErrNil(err, t)
+	defer os.RemoveAll(dir)
+	asserErrNil(archive.Untar(tar, dir, nil), t)
+	for name, content := range files {
+		data, err := ioutil.ReadFile(path.Join(dir, name))
+		asserErrNil(err, t)
+		if string(data) != content {
+			t.Fatalf("expected %v to be %q got %q", name, content, data)
+		}
+	}
+	filesShouldExist(false, unexpectedFiles, dir, t)
+}
+
 func exportUncommitedChangeSet(r *gitRepo, expectedFiles, unexpectedFiles []string, t *testing.T) {
 	tar, err := r.exportUncommitedChangeSet()
 	asserErrNil(err, t)
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_PATH_ENV = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	MAX_SYMLINKS     = 255
+)
+
+//what runtimes need from the image json pulls write at the root of the rootfs
+type imageJSON struct {
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       *imageRunConfig `json:"config"`
+}
+
+type imageRunConfig struct {
+	Env        []string
+	Cmd        []string
+	Entrypoint []string
+	WorkingDir string
+	User       string
+	Volumes    map[string]struct{}
+}
+
+//read the image json of rootfs
+func readImageJSON(rootfs string) (*imageJSON, error) {
+	rawJSON, err := ioutil.ReadFile(path.Join(rootfs, "json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no image json in %v, was it pulled with krgo ?", rootfs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	img := &imageJSON{}
+	if err := json.Unmarshal(rawJSON, img); err != nil {
+		return nil, fmt.Errorf("invalid image json in %v: %v", rootfs, err)
+	}
+	if img.Config == nil {
+		img.Config = &imageRunConfig{}
+	}
+	return img, nil
+}
+
+//command of the image: entrypoint followed by cmd
+func (img *imageJSON) args() ([]string, error) {
+	args := append(append([]string{}, img.Config.Entrypoint...), img.Config.Cmd...)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("image has neither Entrypoint nor Cmd, nothing to run")
+	}
+	return args, nil
+}
+
+//environment of the image process: image Env, with PATH and HOME defaulting like docker does
+func (img *imageJSON) env(user *execUser) []string {
+	env := append([]string{}, img.Config.Env...)
+	if !hasEnv(env, "PATH") {
+		env = append(env, DEFAULT_PATH_ENV)
+	}
+	if !hasEnv(env, "HOME") {
+		env = append(env, "HOME="+user.Home)
+	}
+	return env
+}
+
+func (img *imageJSON) workingDir() string {
+	if img.Config.WorkingDir == "" {
+		return "/"
+	}
+	return img.Config.WorkingDir
+}
+
+//volumes declared by the image, sorted
+func (img *imageJSON) volumes() []string {
+	volumes := []string{}
+	for v := range img.Config.Volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Strings(volumes)
+	return volumes
+}
+
+func hasEnv(env []string, name string) bool {
+	for _, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+//user the image process runs as
+type execUser struct {
+	Name           string //empty if not in /etc/passwd
+	UID            uint32
+	GID            uint32
+	AdditionalGids []uint32
+	Home           string
+}
+
+type passwdEntry struct {
+	Name string
+	UID  uint32
+	GID  uint32
+	Home string
+}
+
+type groupEntry struct {
+	Name    string
+	GID     uint32
+	Members []string
+}
+
+//resolve the image User (user, uid, user:group, uid:gid ...) through the rootfs /etc/passwd and /etc/group.
+//Root if empty. Numeric IDs don't need to be in these files, names do
+func resolveUser(rootfs, spec string) (*execUser, error) {
+	userSpec, groupSpec := spec, ""
+	if i := strings.Index(spec, ":"); i != -1 {
+		userSpec, groupSpec = spec[:i], spec[i+1:]
+	}
+	if userSpec == "" {
+		userSpec = "0"
+	}
+	passwd, err := readPasswd(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := readGroup(rootfs)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &execUser{Home: "/"}
+	uid, uidErr := parseID(userSpec)
+	var entry *passwdEntry
+	for i, e := range passwd {
+		if (uidErr == nil && e.UID == uid) || (uidErr != nil && e.Name == userSpec) {
+			entry = &passwd[i]
+			break
+		}
+	}
+	switch {
+	case entry != nil:
+		u.Name, u.UID, u.GID, u.Home = entry.Name, entry.UID, entry.GID, entry.Home
+	case uidErr == nil:
+		u.UID = uid
+	default:
+		return nil, fmt.Errorf("user %v not found in the rootfs /etc/passwd", userSpec)
+	}
+
+	if groupSpec != "" {
+		gid, err := parseID(groupSpec)
+		if err != nil {
+			found := false
+			for _, g := range groups {
+				if g.Name == groupSpec {
+					gid, found = g.GID, true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("group %v not found in the rootfs /etc/group", groupSpec)
+			}
+		}
+		u.GID = gid
+	}
+
+	//supplementary groups
+	if u.Name != "" {
+		for _, g := range groups {
+			if g.GID == u.GID {
+				continue
+			}
+			for _, member := range g.Members {
+				if member == u.Name {
+					u.AdditionalGids = append(u.AdditionalGids, g.GID)
+					break
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+//entries of the rootfs /etc/passwd, none if it doesn't exist
+func readPasswd(rootfs string) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := readColonFile(rootfs, "/etc/passwd", func(fields []string) {
+		//name:password:uid:gid:gecos:home:shell
+		if len(fields) < 6 {
+			return
+		}
+		uid, err1 := parseID(fields[2])
+		gid, err2 := parseID(fields[3])
+		if err1 == nil && err2 == nil {
+			entries = append(entries, passwdEntry{Name: fields[0], UID: uid, GID: gid, Home: fields[5]})
+		}
+	})
+	return entries, err
+}
+
+//entries of the rootfs /etc/group, none if it doesn't exist
+func readGroup(rootfs string) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := readColonFile(rootfs, "/etc/group", func(fields []string) {
+		//name:password:gid:members
+		if len(fields) < 3 {
+			return
+		}
+		gid, err := parseID(fields[2])
+		if err != nil {
+			return
+		}
+		entry := groupEntry{Name: fields[0], GID: gid}
+		if len(fields) > 3 && fields[3] != "" {
+			entry.Members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+//call fn with the fields of every line of a colon separated file of the rootfs, comments are skipped
+func readColonFile(rootfs, file string, fn func([]string)) error {
+	p, err := pathInRootfs(rootfs, file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return scanColonFile(f, fn)
+}
+
+func scanColonFile(r io.Reader, fn func([]string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
+
+//host path of p in rootfs. Symlinks are resolved as if rootfs was the root, so a rootfs can't make krgo read
+//host files
+func pathInRootfs(rootfs, p string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(path.Clean("/"+p), "/")
+	links := 0
+	for len(rest) > 0 {
+		comp := rest[0]
+		rest = rest[1:]
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, comp)
+		fi, err := os.Lstat(filepath.Join(rootfs, filepath.FromSlash(next)))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > MAX_SYMLINKS {
+			return "", fmt.Errorf("too many symlinks resolving %v in %v", p, rootfs)
+		}
+		target, err := os.Readlink(filepath.Join(rootfs, filepath.FromSlash(next)))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return filepath.Join(rootfs, filepath.FromSlash(resolved)), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/pkg/term"
+	"github.com/docker/docker/registry"
+)
+
+//krgo login [registry_host] -u username
+//validate credentials against the registry and store them for later pulls and pushes
+func loginRegistry(registryHost, userName, password string, insecure bool) error {
+	indexInfo := newIndexInfo(registryHost, insecure)
+	endpoint, err := registry.NewEndpoint(indexInfo)
+	if err != nil {
+		return err
+	}
+
+	authConfig := &registry.AuthConfig{Username: userName, Password: password, ServerAddress: indexInfo.GetAuthConfigKey()}
+	status, err := registry.Login(authConfig, endpoint, registry.HTTPRequestFactory(nil))
+	if err != nil {
+		return err
+	}
+	if err := storeCredentials(indexInfo.Name, authConfig); err != nil {
+		return fmt.Errorf("login succeeded but credentials couldn't be stored: %v", err)
+	}
+	printf("%v\n", status)
+	return nil
+}
+
+//krgo logout [registry_host]
+func logoutRegistry(registryHost string) error {
+	indexInfo := newIndexInfo(registryHost, false)
+	err := eraseCredentials(indexInfo.Name)
+	if err == ErrCredentialsNotFound {
+		return fmt.Errorf("not logged in to %v", indexInfo.Name)
+	}
+	return err
+}
+
+//read the whole input, stripping the trailing new line
+func readPasswordFrom(in io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+//prompt on stdout and read a line on stdin, without echoing it if hidden
+func promptInput(prompt string, hidden bool) (string, error) {
+	fmt.Print(prompt)
+	fd := os.Stdin.Fd()
+	if hidden && term.IsTerminal(fd) {
+		oldState, err := term.SaveState(fd)
+		if err != nil {
+			return "", err
+		}
+		term.DisableEcho(fd, oldState)
+		defer func() {
+			term.RestoreTerminal(fd, oldState)
+			fmt.Println()
+		}()
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/codegangsta/cli"
 	"github.com/docker/docker/dockerversion"
+	"github.com/docker/docker/pkg/term"
 )
 
 const (
@@ -16,42 +19,150 @@ const (
 
 var (
 	//shared flags
-	userFlag   = cli.StringFlag{Name: "u, user", Usage: "dockerhub credentials (format: username:password)"}
-	rootfsFlag = cli.StringFlag{Name: "r, rootfs", Usage: "path of the root FS (default: rootfs)", Value: "rootfs"}
+	userFlag        = cli.StringFlag{Name: "u, user", Usage: "registry credentials (format: username:password, default: docker config files and credential helpers)"}
+	rootfsFlag      = cli.StringFlag{Name: "r, rootfs", Usage: "path of the root FS (default: rootfs)", Value: "rootfs"}
+	registryFlag    = cli.StringFlag{Name: "registry", Usage: "registry host (format: host[:port], default: docker hub)"}
+	insecureFlag    = cli.BoolFlag{Name: "insecure", Usage: "allow plain HTTP and unverified TLS connections to the registry"}
+	concurrencyFlag = cli.IntFlag{Name: "concurrency", Value: DEFAULT_CONCURRENCY, Usage: "number of layers transferred in parallel"}
+	limitRateFlag   = cli.StringFlag{Name: "limit-rate", Usage: "overall bandwidth limit (format: <number>[K|M|G] bytes per second, e.g. 10M)"}
+	outputFlag      = cli.StringFlag{Name: "output", Value: OUTPUT_TEXT, Usage: "output format: text or json (result printed as json on stdout, messages go to stderr)"}
+	progressEvsFlag = cli.BoolFlag{Name: "progress-events", Usage: "with --output json, print transfer progress as json lines (NDJSON) before the result"}
 
 	//commands
 	pullCmd = cli.Command{
 		Name:        "pull",
 		Usage:       "pull an image",
-		Description: "pull image [-r rootfs] [-u user] [-g] [-v2]",
+		Description: "pull [registry_host/]image [-r rootfs] [-u user] [-g] [-v2] [--platform os/arch[/variant] | --all-platforms] [--retries n] [--concurrency n] [--limit-rate rate] [--no-cache] [--insecure-skip-verify] [--signature-policy permissive|strict] [--trusted-keys file] [--oci-layout dir | --bundle] [--registry host] [--insecure] [--output text|json [--progress-events]]",
 		Action:      pull,
 		Flags: []cli.Flag{
 			cli.BoolFlag{Name: "g, git-layering", Usage: "use git layering (needed to push afteward)"},
 			userFlag,
 			rootfsFlag,
-			cli.BoolFlag{Name: "v2", Usage: "use docker V2 registry (push not available yet for images pulled with this flag)"},
+			registryFlag,
+			insecureFlag,
+			cli.BoolFlag{Name: "v2", Usage: "use docker V2 registry (images pulled with this flag must be pushed with -v2)"},
+			cli.StringFlag{Name: "platform", Usage: "platform of multi platform images (format: os/arch[/variant], default: host platform)"},
+			cli.BoolFlag{Name: "all-platforms", Usage: "pull every platform of multi platform images, each in rootfs_<os>_<arch>[_<variant>]"},
+			cli.IntFlag{Name: "retries", Value: DEFAULT_RETRIES, Usage: "number of retries of failed layer downloads (exponential backoff)"},
+			concurrencyFlag,
+			limitRateFlag,
+			cli.BoolFlag{Name: "no-cache", Usage: "don't use nor fill the local layer cache"},
+			cli.StringFlag{Name: "signature-policy", Value: SIGNATURE_POLICY_PERMISSIVE, Usage: "schema1 manifest signatures policy: permissive (warn about unsigned manifests and unknown keys) or strict (reject them, and reject schema2 and OCI manifests that can't be signed)"},
+			cli.StringFlag{Name: "trusted-keys", Usage: "file of trusted manifest signing keys, JWK set or PEM (default: ~/.krgo/trusted_keys.json if present)"},
+			cli.BoolFlag{Name: "insecure-skip-verify", Usage: "don't verify layers against their digest (dangerous: corrupted or tampered layers are applied)"},
+			cli.StringFlag{Name: "oci-layout", Usage: "store the image manifests and blobs as is in this OCI image layout directory instead of a rootfs"},
+			cli.BoolFlag{Name: "bundle", Usage: "write a runc config.json next to the rootfs (see krgo bundle)"},
+			outputFlag,
+			progressEvsFlag,
 		},
 	}
 
 	pushCmd = cli.Command{
 		Name:        "push",
 		Usage:       "push an image",
-		Description: "push image [-r rootfs] -u user",
+		Description: "push [registry_host/]image [-r rootfs | --from-oci dir] -u user [-v2] [--concurrency n] [--limit-rate rate] [--registry host] [--insecure] [--output text|json [--progress-events]]",
 		Action:      push,
 		Flags: []cli.Flag{
 			userFlag,
 			rootfsFlag,
+			registryFlag,
+			insecureFlag,
+			concurrencyFlag,
+			limitRateFlag,
+			cli.BoolFlag{Name: "v2", Usage: "use docker V2 registry (needed for images pulled with -v2)"},
+			cli.StringFlag{Name: "from-oci", Usage: "push the manifest named after the image tag (or the only one) of this OCI image layout directory, uses the V2 registry"},
+			outputFlag,
+			progressEvsFlag,
+		},
+	}
+
+	loginCmd = cli.Command{
+		Name:        "login",
+		Usage:       "log in to a registry",
+		Description: "login [registry_host] [-u username] [--password-stdin] [--insecure]",
+		Action:      login,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "u, username", Usage: "username (prompted if not given)"},
+			cli.BoolFlag{Name: "password-stdin", Usage: "read the password from stdin instead of prompting it"},
+			insecureFlag,
+		},
+	}
+
+	logoutCmd = cli.Command{
+		Name:        "logout",
+		Usage:       "log out from a registry",
+		Description: "logout [registry_host]",
+		Action:      logout,
+	}
+
+	cacheCmd = cli.Command{
+		Name:        "cache",
+		Usage:       "manage the local layer cache",
+		Description: "cache ls | verify | prune [--older-than age] [--max-size size]",
+		Action:      cache,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "older-than", Usage: "prune entries not used for this long (format: 30d, 36h ...)"},
+			cli.StringFlag{Name: "max-size", Usage: "prune least recently used entries until the cache fits (format: 500M, 10G ...)"},
+		},
+	}
+
+	exportCmd = cli.Command{
+		Name:        "export",
+		Usage:       "export an image pulled with -g as a tarball",
+		Description: "export file.tar [-r rootfs] [--format docker-archive] [-t image[:tag]]",
+		Action:      export,
+		Flags: []cli.Flag{
+			rootfsFlag,
+			cli.StringFlag{Name: "format", Value: ARCHIVE_FORMAT_DOCKER, Usage: "tarball format: docker-archive (docker save / docker load format)"},
+			cli.StringFlag{Name: "t, tag", Usage: "name of the image in the tarball (format: [registry_host/]image[:tag])"},
+		},
+	}
+
+	loadCmd = cli.Command{
+		Name:        "load",
+		Usage:       "load an image from a docker save tarball into a git layered rootfs",
+		Description: "load file.tar [-r rootfs] [-t image[:tag]]",
+		Action:      load,
+		Flags: []cli.Flag{
+			rootfsFlag,
+			cli.StringFlag{Name: "t, tag", Usage: "image to load from tarballs holding several (format: [registry_host/]image[:tag])"},
+		},
+	}
+
+	bundleCmd = cli.Command{
+		Name:        "bundle",
+		Usage:       "write a runc config.json for a pulled image",
+		Description: "bundle [-r rootfs] [-b bundle_dir] [--tty]",
+		Action:      bundle,
+		Flags: []cli.Flag{
+			rootfsFlag,
+			cli.StringFlag{Name: "b, bundle-dir", Usage: "directory config.json is written in (default: the rootfs parent directory)"},
+			cli.BoolFlag{Name: "tty", Usage: "run the image process with a terminal"},
+		},
+	}
+
+	configGenCmd = cli.Command{
+		Name:        "config-gen",
+		Usage:       "generate an LXC or libcontainer config for a pulled image",
+		Description: "config-gen --engine lxc|libcontainer [-r rootfs] [-f file] [--tty]",
+		Action:      configGen,
+		Flags: []cli.Flag{
+			rootfsFlag,
+			cli.StringFlag{Name: "engine", Usage: "container engine: lxc or libcontainer"},
+			cli.StringFlag{Name: "f, file", Usage: "path of the generated config (default: lxc-config or container.json in the rootfs parent directory)"},
+			cli.BoolFlag{Name: "tty", Usage: "run the image process with a terminal (libcontainer)"},
 		},
 	}
 
 	commitCmd = cli.Command{
 		Name:        "commit",
 		Usage:       "commit changes to an image pulled with -g",
-		Description: "commit [-r rootfs] -m message",
+		Description: "commit [-r rootfs] -m message [--output text|json]",
 		Action:      commit,
 		Flags: []cli.Flag{
 			cli.StringFlag{Name: "m, message", Usage: "commit message"},
 			rootfsFlag,
+			outputFlag,
 		},
 	}
 )
@@ -67,62 +178,348 @@ func main() {
 	app.Usage = "docker hub without docker"
 	app.Author = "Robin Monjo"
 	app.Email = "robinmonjo@gmail.com"
-	app.Commands = []cli.Command{pullCmd, pushCmd, commitCmd}
+	app.Commands = []cli.Command{pullCmd, pushCmd, commitCmd, exportCmd, loadCmd, bundleCmd, configGenCmd, loginCmd, logoutCmd, cacheCmd}
 
 	app.Run(os.Args)
 }
 
 func pull(c *cli.Context) {
-	imageName, imageTag := parseImageNameTag(c.Args().First())
+	if err := setOutput(c); err != nil {
+		fatal(err)
+	}
+	ref, err := parseImageArg(c)
+	if err != nil {
+		fatal(err)
+	}
 	userName, password := parseCredentials(c.String("user"))
 
-	fmt.Printf("Pulling image %v:%v ...\n", imageName, imageTag)
-	session, err := newRegistrySession(userName, password)
+	printf("Pulling image %v ...\n", ref)
+	session, err := newRegistrySession(userName, password, ref.Registry, c.Bool("insecure"))
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	session.report.Image, session.report.Rootfs = ref.String(), c.String("rootfs")
+	session.retryPolicy = newRetryPolicy(c.Int("retries"))
+	if err := setTransferLimits(session, c); err != nil {
+		fatal(err)
+	}
+	if c.Bool("no-cache") {
+		session.cache = nil
+	}
+	if session.sigPolicy, err = newSignaturePolicy(c.String("signature-policy"), c.String("trusted-keys")); err != nil {
+		fatal(err)
+	}
+	if c.Bool("insecure-skip-verify") {
+		printf("WARNING: layer verification disabled, the rootfs may be corrupted or tampered with\n")
+		session.skipVerify = true
+	}
+
+	var p *platform
+	if c.String("platform") != "" && c.Bool("all-platforms") {
+		fatalf("--platform and --all-platforms are mutually exclusive")
+	}
+	if c.String("platform") != "" {
+		if p, err = parsePlatform(c.String("platform")); err != nil {
+			fatal(err)
+		}
+	}
+
+	if c.Bool("bundle") && (c.String("oci-layout") != "" || c.Bool("all-platforms")) {
+		fatalf("--bundle can't be used with --oci-layout nor --all-platforms")
 	}
 
-	if c.Bool("git-layering") {
-		if c.Bool("v2") {
-			err = session.pullRepositoryV2(imageName, imageTag, c.String("rootfs"))
+	//content digests and multi platform images only exist on the V2 registry
+	useV2 := c.Bool("v2") || session.v2Only() || ref.Digest != "" || p != nil || c.Bool("all-platforms")
+	if c.String("oci-layout") != "" {
+		if c.Bool("git-layering") {
+			fatalf("--oci-layout and -g are mutually exclusive")
+		}
+		session.report.Rootfs = ""
+		session.report.Layout = c.String("oci-layout")
+		err = session.pullOCILayout(ref.Name, ref.reference(), c.String("oci-layout"), p, c.Bool("all-platforms"))
+	} else if c.Bool("all-platforms") {
+		err = session.pullAllPlatformsV2(ref.Name, ref.reference(), c.String("rootfs"), c.Bool("git-layering"))
+	} else if c.Bool("git-layering") {
+		if useV2 {
+			err = session.pullRepositoryV2(ref.Name, ref.reference(), c.String("rootfs"), p)
 		} else {
-			err = session.pullRepository(imageName, imageTag, c.String("rootfs"))
+			err = session.pullRepository(ref.Name, ref.Tag, c.String("rootfs"))
 		}
 	} else {
-		if c.Bool("v2") {
-			err = session.pullImageV2(imageName, imageTag, c.String("rootfs"))
+		if useV2 {
+			err = session.pullImageV2(ref.Name, ref.reference(), c.String("rootfs"), p)
 		} else {
-			err = session.pullImage(imageName, imageTag, c.String("rootfs"))
+			err = session.pullImage(ref.Name, ref.Tag, c.String("rootfs"))
 		}
 	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	fmt.Printf("Done. Rootfs of %v:%v in %v\n", imageName, imageTag, c.String("rootfs"))
+	if c.String("oci-layout") != "" {
+		printf("Done. %v stored in %v\n", ref, c.String("oci-layout"))
+	} else {
+		printf("Done. Rootfs of %v in %v\n", ref, c.String("rootfs"))
+	}
+	if c.Bool("bundle") {
+		configPath, err := createBundle(c.String("rootfs"), "", false)
+		if err != nil {
+			fatal(wrapError(err, "image pulled but the bundle couldn't be created: %v", err))
+		}
+		printf("Bundle config written to %v\n", configPath)
+	}
+	emitReport(session.report)
 }
 
 func commit(c *cli.Context) {
-	err := commitChanges(c.String("rootfs"), c.String("message"))
+	if err := setOutput(c); err != nil {
+		fatal(err)
+	}
+	report, err := commitChanges(c.String("rootfs"), c.String("message"))
 	if err != nil {
-		log.Fatalf("Something went wrong: %v\nGit repo may have been altered. Please make sure it's fine before commiting again\n", err)
+		fatal(wrapError(err, "Something went wrong: %v\nGit repo may have been altered. Please make sure it's fine before commiting again", err))
+	}
+	printf("Done\n")
+	if jsonOut != nil {
+		jsonOut.emit(report)
 	}
-	fmt.Printf("Done\n")
+}
+
+func export(c *cli.Context) {
+	dest := c.Args().First()
+	if dest == "" {
+		fatalf("missing tarball path")
+	}
+	if c.String("format") != ARCHIVE_FORMAT_DOCKER {
+		fatalf("unknown export format %q, expected %v", c.String("format"), ARCHIVE_FORMAT_DOCKER)
+	}
+	var ref *imageReference
+	if c.String("tag") != "" {
+		var err error
+		if ref, err = parseImageReference(c.String("tag"), ""); err != nil {
+			fatal(err)
+		}
+		if ref.Digest != "" {
+			fatalf("can't name an exported image with a digest (%v), use a tag instead", ref)
+		}
+	}
+	if err := exportDockerArchive(c.String("rootfs"), dest, ref); err != nil {
+		fatal(err)
+	}
+	printf("Done. Image of %v exported to %v\n", c.String("rootfs"), dest)
+}
+
+func load(c *cli.Context) {
+	src := c.Args().First()
+	if src == "" {
+		fatalf("missing tarball path")
+	}
+	var ref *imageReference
+	if c.String("tag") != "" {
+		var err error
+		if ref, err = parseImageReference(c.String("tag"), ""); err != nil {
+			fatal(err)
+		}
+	}
+	if err := loadDockerArchive(src, c.String("rootfs"), ref); err != nil {
+		fatal(err)
+	}
+	printf("Done. Rootfs of %v in %v\n", src, c.String("rootfs"))
+}
+
+func bundle(c *cli.Context) {
+	configPath, err := createBundle(c.String("rootfs"), c.String("bundle-dir"), c.Bool("tty"))
+	if err != nil {
+		fatal(err)
+	}
+	printf("Done. Bundle config written to %v, run it with: runc run -b %v <container_id>\n", configPath, filepath.Dir(configPath))
+}
+
+func configGen(c *cli.Context) {
+	if c.String("engine") == "" {
+		fatalf("missing --engine (%v or %v)", ENGINE_LXC, ENGINE_LIBCONTAINER)
+	}
+	configPath, err := generateConfig(c.String("engine"), c.String("rootfs"), c.String("file"), c.Bool("tty"))
+	if err != nil {
+		fatal(err)
+	}
+	printf("Done. %v config written to %v\n", c.String("engine"), configPath)
 }
 
 func push(c *cli.Context) {
-	imageName, imageTag := parseImageNameTag(c.Args().First())
+	if err := setOutput(c); err != nil {
+		fatal(err)
+	}
+	ref, err := parseImageArg(c)
+	if err != nil {
+		fatal(err)
+	}
+	if ref.Digest != "" {
+		fatalf("can't push to a digest reference (%v), use a tag instead", ref)
+	}
 	userName, password := parseCredentials(c.String("user"))
 
-	fmt.Printf("Pushing image %v:%v ...\n", imageName, imageTag)
-	session, err := newRegistrySession(userName, password)
+	printf("Pushing image %v ...\n", ref)
+	session, err := newRegistrySession(userName, password, ref.Registry, c.Bool("insecure"))
+	if err != nil {
+		fatal(err)
+	}
+	session.report.Image, session.report.Rootfs = ref.String(), c.String("rootfs")
+	if err := setTransferLimits(session, c); err != nil {
+		fatal(err)
+	}
+
+	if c.String("from-oci") != "" {
+		session.report.Rootfs = ""
+		session.report.Layout = c.String("from-oci")
+		err = session.pushOCILayout(ref.Name, ref.Tag, c.String("from-oci"))
+	} else if c.Bool("v2") || session.v2Only() {
+		err = session.pushRepositoryV2(ref.Name, ref.Tag, c.String("rootfs"))
+	} else {
+		err = session.pushRepository(ref.Name, ref.Tag, c.String("rootfs"))
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if ref.isDockerHub() {
+		printf("Done: https://registry.hub.docker.com/u/%s\n", ref.Name)
+	} else {
+		printf("Done: %v\n", ref)
+	}
+	emitReport(session.report)
+}
+
+//apply --output and --progress-events. With json output, stdout is left to json objects and messages go to stderr
+func setOutput(c *cli.Context) error {
+	switch c.String("output") {
+	case OUTPUT_TEXT:
+		if c.Bool("progress-events") {
+			return fmt.Errorf("--progress-events requires --output json")
+		}
+	case OUTPUT_JSON:
+		jsonOut = newJSONOutput(os.Stdout, c.Bool("progress-events"))
+		stdout.w, stdout.tty = os.Stderr, term.IsTerminal(os.Stderr.Fd())
+	default:
+		return fmt.Errorf("unknown output format %q, expected %v or %v", c.String("output"), OUTPUT_TEXT, OUTPUT_JSON)
+	}
+	return nil
+}
+
+//print the result of a transfer with --output json
+func emitReport(report *transferReport) {
+	if jsonOut == nil {
+		return
+	}
+	report.finish()
+	jsonOut.emit(report)
+}
+
+//log err and exit with the code of its kind (see errors.go). err is also reported as json with --output json
+func fatal(err error) {
+	code := exitCode(err)
+	if jsonOut != nil {
+		jsonOut.emit(&errorReport{Error: strings.TrimSpace(err.Error()), Kind: errorKind(code), ExitCode: code})
+	}
+	log.Print(err)
+	os.Exit(code)
+}
+
+func fatalf(format string, v ...interface{}) {
+	fatal(fmt.Errorf(format, v...))
+}
+
+//apply --concurrency and --limit-rate to the session
+func setTransferLimits(session *registrySession, c *cli.Context) error {
+	if c.Int("concurrency") < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+	session.concurrency = c.Int("concurrency")
+	if c.String("limit-rate") != "" {
+		rate, err := parseSize(c.String("limit-rate"))
+		if err != nil {
+			return err
+		}
+		if rate <= 0 {
+			return fmt.Errorf("--limit-rate must be positive")
+		}
+		session.rateLimiter = newRateLimiter(rate)
+	}
+	return nil
+}
+
+//parse the image argument. Registry host is taken from the image name if present, from the --registry flag otherwise
+func parseImageArg(c *cli.Context) (*imageReference, error) {
+	return parseImageReference(c.Args().First(), c.String("registry"))
+}
+
+func login(c *cli.Context) {
+	registryHost := c.Args().First()
+	userName := c.String("username")
+	var (
+		password string
+		err      error
+	)
+
+	if c.Bool("password-stdin") {
+		if userName == "" {
+			fatalf("--password-stdin requires a username (-u)")
+		}
+		password, err = readPasswordFrom(os.Stdin)
+	} else {
+		if userName == "" {
+			if userName, err = promptInput("Username: ", false); err != nil {
+				fatal(err)
+			}
+		}
+		password, err = promptInput("Password: ", true)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+	if userName == "" || password == "" {
+		fatalf("username and password are required")
+	}
+
+	if err := loginRegistry(registryHost, userName, password, c.Bool("insecure")); err != nil {
+		fatal(err)
+	}
+}
 
-	err = session.pushRepository(imageName, imageTag, c.String("rootfs"))
+func logout(c *cli.Context) {
+	registryHost := c.Args().First()
+	if err := logoutRegistry(registryHost); err != nil {
+		fatal(err)
+	}
+	printf("Removed credentials of %v\n", newIndexInfo(registryHost, false).Name)
+}
+
+func cache(c *cli.Context) {
+	var err error
+	switch c.Args().First() {
+	case "ls":
+		err = listCache()
+	case "verify":
+		err = verifyCache()
+	case "prune":
+		maxAge, maxSize := NO_AGE_LIMIT, NO_SIZE_LIMIT
+		if c.String("older-than") == "" && c.String("max-size") == "" {
+			fatalf("prune requires --older-than and/or --max-size")
+		}
+		if c.String("older-than") != "" {
+			if maxAge, err = parseAge(c.String("older-than")); err != nil {
+				fatal(err)
+			}
+		}
+		if c.String("max-size") != "" {
+			if maxSize, err = parseSize(c.String("max-size")); err != nil {
+				fatal(err)
+			}
+		}
+		err = pruneCache(maxAge, maxSize)
+	default:
+		fatalf("unknown cache command %q, expected ls, verify or prune", c.Args().First())
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
-	fmt.Printf("Done: https://registry.hub.docker.com/%s/%s\n", userName, imageName)
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/registry"
+)
+
+const (
+	MEDIATYPE_DOCKER_SCHEMA1        = "application/vnd.docker.distribution.manifest.v1+json"
+	MEDIATYPE_DOCKER_SCHEMA1_SIGNED = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MEDIATYPE_DOCKER_SCHEMA2        = "application/vnd.docker.distribution.manifest.v2+json"
+	MEDIATYPE_OCI_MANIFEST          = "application/vnd.oci.image.manifest.v1+json"
+	MEDIATYPE_DOCKER_MANIFEST_LIST  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MEDIATYPE_OCI_INDEX             = "application/vnd.oci.image.index.v1+json"
+)
+
+//annotation of manifest list entries that aren't images but are about one (attestations)
+const DOCKER_REFERENCE_TYPE_ANNOTATION = "vnd.docker.reference.type"
+
+//media types krgo can pull, sent as Accept header when fetching manifests
+var supportedManifestMediaTypes = []string{
+	MEDIATYPE_DOCKER_MANIFEST_LIST,
+	MEDIATYPE_OCI_INDEX,
+	MEDIATYPE_DOCKER_SCHEMA2,
+	MEDIATYPE_OCI_MANIFEST,
+	MEDIATYPE_DOCKER_SCHEMA1_SIGNED,
+	MEDIATYPE_DOCKER_SCHEMA1,
+}
+
+//content descriptor, as found in schema2 and OCI manifests
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Size        int64             `json:"size"`
+	Digest      string            `json:"digest"`
+	Platform    *platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+//docker schema2 and OCI image manifests share the same layout
+type schema2Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+//docker manifest lists and OCI indexes point to a manifest per platform
+type manifestList struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+//what a pull needs to know from a manifest, whatever its format
+type imageManifest struct {
+	MediaType string
+	Layers    []descriptor //base layer first
+	Config    *descriptor  //config blob, nil for schema1 manifests
+	V1Compat  []byte       //json of the top layer, schema1 manifests only
+}
+
+//media type of a manifest, from the Content-Type the registry gave or guessed from the content
+func manifestMediaType(rawManifest []byte, contentType string) string {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	if mediaType == "" || mediaType == "application/json" || mediaType == "text/plain" {
+		mediaType = guessManifestMediaType(rawManifest)
+	}
+	return mediaType
+}
+
+func isManifestList(mediaType string) bool {
+	return mediaType == MEDIATYPE_DOCKER_MANIFEST_LIST || mediaType == MEDIATYPE_OCI_INDEX
+}
+
+func parseManifestList(rawManifest []byte) (*manifestList, error) {
+	var list manifestList
+	if err := json.Unmarshal(rawManifest, &list); err != nil {
+		return nil, err
+	}
+	if len(list.Manifests) == 0 {
+		return nil, fmt.Errorf("manifest list is empty")
+	}
+	return &list, nil
+}
+
+//manifests of the list that are images of a platform. Attestation manifests BuildKit adds to lists
+//(unknown/unknown platform, vnd.docker.reference.type annotation) aren't images and are skipped
+func (list *manifestList) images() []descriptor {
+	var images []descriptor
+	for _, m := range list.Manifests {
+		if m.Platform == nil || m.Platform.OS == "unknown" || m.Platform.Architecture == "unknown" {
+			continue
+		}
+		if _, ok := m.Annotations[DOCKER_REFERENCE_TYPE_ANNOTATION]; ok {
+			continue
+		}
+		images = append(images, m)
+	}
+	return images
+}
+
+//manifest of the list matching p
+func (list *manifestList) selectPlatform(p *platform) (*descriptor, error) {
+	var available []string
+	images := list.images()
+	for i, m := range images {
+		if p.matches(m.Platform) {
+			return &images[i], nil
+		}
+		available = append(available, m.Platform.String())
+	}
+	return nil, fmt.Errorf("no image for platform %v (available: %v)", p, strings.Join(available, ", "))
+}
+
+//parse an image manifest according to its media type (see manifestMediaType)
+func parseManifest(rawManifest []byte, contentType string) (*imageManifest, error) {
+	mediaType := manifestMediaType(rawManifest, contentType)
+
+	switch mediaType {
+	case MEDIATYPE_DOCKER_SCHEMA1, MEDIATYPE_DOCKER_SCHEMA1_SIGNED:
+		var manifest registry.ManifestData
+		if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+			return nil, err
+		}
+		return schema1ImageManifest(&manifest, mediaType)
+
+	case MEDIATYPE_DOCKER_SCHEMA2, MEDIATYPE_OCI_MANIFEST:
+		var manifest schema2Manifest
+		if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+			return nil, err
+		}
+		if manifest.SchemaVersion != 2 {
+			return nil, fmt.Errorf("unexpected schema version %d for %v manifest", manifest.SchemaVersion, mediaType)
+		}
+		if len(manifest.Layers) == 0 {
+			return nil, fmt.Errorf("manifest has no layers")
+		}
+		config := manifest.Config
+		return &imageManifest{MediaType: mediaType, Layers: manifest.Layers, Config: &config}, nil
+	}
+	return nil, fmt.Errorf("unsupported manifest media type %q", mediaType)
+}
+
+//schema1 manifests don't have a media type field, schema2 and OCI ones have a schema version of 2.
+//OCI indexes are told apart from OCI manifests by their manifests entry
+func guessManifestMediaType(rawManifest []byte) string {
+	var versioned struct {
+		SchemaVersion int               `json:"schemaVersion"`
+		MediaType     string            `json:"mediaType"`
+		Manifests     []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(rawManifest, &versioned); err != nil {
+		return ""
+	}
+	switch {
+	case versioned.MediaType != "":
+		return versioned.MediaType
+	case versioned.SchemaVersion == 1:
+		return MEDIATYPE_DOCKER_SCHEMA1
+	case versioned.SchemaVersion == 2 && versioned.Manifests != nil:
+		return MEDIATYPE_OCI_INDEX
+	case versioned.SchemaVersion == 2:
+		return MEDIATYPE_OCI_MANIFEST
+	}
+	return ""
+}
+
+func schema1ImageManifest(manifest *registry.ManifestData, mediaType string) (*imageManifest, error) {
+	if len(manifest.FSLayers) == 0 {
+		return nil, fmt.Errorf("manifest of %v has no layers", manifest.Name)
+	}
+	m := &imageManifest{MediaType: mediaType}
+	if len(manifest.History) > 0 {
+		m.V1Compat = []byte(manifest.History[0].V1Compatibility)
+	}
+
+	printf("Manifest contains %d layers, try to cleanup ...\n", len(manifest.FSLayers))
+	cleanupManifest(manifest)
+
+	//schema1 layers are ordered top layer first
+	for i := len(manifest.FSLayers) - 1; i >= 0; i-- {
+		m.Layers = append(m.Layers, descriptor{Digest: manifest.FSLayers[i].BlobSum})
+	}
+	return m, nil
+}
+
+//Layers are now addressed by content, i.e identified by their tarsum (https://github.com/docker/docker-registry/issues/612)
+//v1 registry required to push the layer json, that made a lot of "duplicated layer"
+//So images manifests contain duplicated layers (layers with same content and then same tarsum), we can clean them up
+func cleanupManifest(manifest *registry.ManifestData) {
+	found := make(map[string]bool)
+	cleanFSLayers := []*registry.FSLayer{}
+	for _, layer := range manifest.FSLayers {
+		if !found[layer.BlobSum] {
+			found[layer.BlobSum] = true
+			cleanFSLayers = append(cleanFSLayers, &registry.FSLayer{BlobSum: layer.BlobSum})
+		}
+	}
+	manifest.FSLayers = cleanFSLayers
+}
+
+//layers are pulled by digest, a layer present twice is only downloaded once (it is applied every time it's present)
+func uniqueLayers(layers []descriptor) []descriptor {
+	found := make(map[string]bool)
+	var unique []descriptor
+	for _, layer := range layers {
+		if !found[layer.Digest] {
+			found[layer.Digest] = true
+			unique = append(unique, layer)
+		}
+	}
+	return unique
+}
+
+//build the v1 image json written in the rootfs (like V1 pulls do) from an image config
+//(config blob or schema1 top layer json): id and parent are set, schema2 specific entries are dropped
+func v1ImageJSON(rawConfig []byte, id, parent string) ([]byte, error) {
+	config := make(map[string]interface{})
+	if len(rawConfig) > 0 {
+		if err := json.Unmarshal(rawConfig, &config); err != nil {
+			return nil, fmt.Errorf("invalid image config: %v", err)
+		}
+	}
+	delete(config, "rootfs")
+	delete(config, "history")
+	config["id"] = id
+	if parent != "" {
+		config["parent"] = parent
+	} else {
+		delete(config, "parent")
+	}
+	return json.Marshal(config)
+}
+
+//image config (docker schema2 / OCI) of a v1 image json, the reverse of v1ImageJSON. diffIDs are the sha256
+//digests of the uncompressed layers, base layer first
+func imageConfigFromV1JSON(rawJSON []byte, diffIDs []string) ([]byte, error) {
+	config := make(map[string]interface{})
+	if err := json.Unmarshal(rawJSON, &config); err != nil {
+		return nil, fmt.Errorf("invalid image json: %v", err)
+	}
+	for _, key := range []string{"id", "parent", "Size", "parent_id", "layer_id"} {
+		delete(config, key)
+	}
+	if os, _ := config["os"].(string); os == "" {
+		config["os"] = hostPlatform().OS
+	}
+	if arch, _ := config["architecture"].(string); arch == "" {
+		config["architecture"] = hostPlatform().Architecture
+	}
+	config["rootfs"] = map[string]interface{}{"type": "layers", "diff_ids": diffIDs}
+	return json.Marshal(config)
+}
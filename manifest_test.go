@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+const (
+	schema1Manifest = `{
+   "schemaVersion": 1,
+   "name": "library/busybox",
+   "tag": "latest",
+   "architecture": "amd64",
+   "fsLayers": [
+      {"blobSum": "tarsum.dev+sha256:top"},
+      {"blobSum": "tarsum.dev+sha256:empty"},
+      {"blobSum": "tarsum.dev+sha256:base"},
+      {"blobSum": "tarsum.dev+sha256:empty"}
+   ],
+   "history": [
+      {"v1Compatibility": "{\"id\":\"top\",\"config\":{\"Cmd\":[\"sh\"]}}"},
+      {"v1Compatibility": "{\"id\":\"empty\"}"},
+      {"v1Compatibility": "{\"id\":\"base\"}"},
+      {"v1Compatibility": "{\"id\":\"empty\"}"}
+   ]
+}`
+
+	schema2ManifestRaw = `{
+   "schemaVersion": 2,
+   "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+   "config": {"mediaType": "application/vnd.docker.container.image.v1+json", "size": 1469, "digest": "sha256:config"},
+   "layers": [
+      {"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 760770, "digest": "sha256:base"},
+      {"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 32, "digest": "sha256:top"}
+   ]
+}`
+
+	ociManifestRaw = `{
+   "schemaVersion": 2,
+   "config": {"mediaType": "application/vnd.oci.image.config.v1+json", "size": 1469, "digest": "sha256:config"},
+   "layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "size": 760770, "digest": "sha256:base"}]
+}`
+)
+
+func layerDigests(m *imageManifest) []string {
+	var digests []string
+	for _, l := range m.Layers {
+		digests = append(digests, l.Digest)
+	}
+	return digests
+}
+
+func assertDigests(m *imageManifest, expected []string, t *testing.T) {
+	digests := layerDigests(m)
+	if fmt.Sprint(digests) != fmt.Sprint(expected) {
+		t.Fatalf("got layers %v expected %v", digests, expected)
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	fmt.Printf("Testing manifest parsing ... ")
+	m, err := parseManifest([]byte(schema1Manifest), MEDIATYPE_DOCKER_SCHEMA1_SIGNED)
+	asserErrNil(err, t)
+	assertDigests(m, []string{"tarsum.dev+sha256:base", "tarsum.dev+sha256:empty", "tarsum.dev+sha256:top"}, t)
+	if m.Config != nil || string(m.V1Compat) != `{"id":"top","config":{"Cmd":["sh"]}}` {
+		t.Fatalf("unexpected schema1 metadata %v %s", m.Config, m.V1Compat)
+	}
+
+	m, err = parseManifest([]byte(schema2ManifestRaw), MEDIATYPE_DOCKER_SCHEMA2+"; charset=utf-8")
+	asserErrNil(err, t)
+	assertDigests(m, []string{"sha256:base", "sha256:top"}, t)
+	if m.Config == nil || m.Config.Digest != "sha256:config" {
+		t.Fatalf("expected config sha256:config got %v", m.Config)
+	}
+
+	//a layer present twice is kept at both places, but downloaded once
+	m, err = parseManifest([]byte(`{"schemaVersion": 2, "config": {"digest": "sha256:config"}, "layers": [{"digest": "sha256:a"}, {"digest": "sha256:b"}, {"digest": "sha256:a"}]}`), MEDIATYPE_OCI_MANIFEST)
+	asserErrNil(err, t)
+	assertDigests(m, []string{"sha256:a", "sha256:b", "sha256:a"}, t)
+	assertDigests(&imageManifest{Layers: uniqueLayers(m.Layers)}, []string{"sha256:a", "sha256:b"}, t)
+
+	//media type guessed from content
+	m, err = parseManifest([]byte(ociManifestRaw), "application/json")
+	asserErrNil(err, t)
+	if m.MediaType != MEDIATYPE_OCI_MANIFEST {
+		t.Fatalf("expected %v got %v", MEDIATYPE_OCI_MANIFEST, m.MediaType)
+	}
+	m, err = parseManifest([]byte(schema1Manifest), "")
+	asserErrNil(err, t)
+	if m.MediaType != MEDIATYPE_DOCKER_SCHEMA1 {
+		t.Fatalf("expected %v got %v", MEDIATYPE_DOCKER_SCHEMA1, m.MediaType)
+	}
+
+	if _, err := parseManifest([]byte(`{"schemaVersion": 2, "layers": []}`), MEDIATYPE_OCI_MANIFEST); err == nil {
+		t.Fatal("expected an error for a manifest without layers")
+	}
+	if _, err := parseManifest([]byte(`{}`), "application/vnd.unknown+json"); err == nil {
+		t.Fatal("expected an error for an unknown media type")
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestV1ImageJSON(t *testing.T) {
+	config := `{"architecture":"amd64","os":"linux","config":{"Env":["PATH=/bin"],"Cmd":["sh"]},"rootfs":{"type":"layers"},"history":[]}`
+	raw, err := v1ImageJSON([]byte(config), "top", "base")
+	asserErrNil(err, t)
+
+	var img map[string]interface{}
+	asserErrNil(json.Unmarshal(raw, &img), t)
+	if img["id"] != "top" || img["parent"] != "base" || img["os"] != "linux" || img["config"] == nil {
+		t.Fatalf("unexpected v1 json %s", raw)
+	}
+	if _, ok := img["rootfs"]; ok {
+		t.Fatalf("rootfs should have been dropped: %s", raw)
+	}
+}
+
+func TestImageConfigFromV1JSON(t *testing.T) {
+	v1JSON := `{"id":"top","parent":"base","Size":12,"architecture":"arm64","config":{"Cmd":["sh"]}}`
+	raw, err := imageConfigFromV1JSON([]byte(v1JSON), []string{"sha256:aa", "sha256:bb"})
+	asserErrNil(err, t)
+
+	var config struct {
+		ID           string `json:"id"`
+		Parent       string `json:"parent"`
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		RootFS       struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	asserErrNil(json.Unmarshal(raw, &config), t)
+	if config.ID != "" || config.Parent != "" || config.OS != hostPlatform().OS || config.Architecture != "arm64" {
+		t.Fatalf("unexpected image config %s", raw)
+	}
+	if config.RootFS.Type != "layers" || len(config.RootFS.DiffIDs) != 2 || config.RootFS.DiffIDs[1] != "sha256:bb" {
+		t.Fatalf("unexpected rootfs %s", raw)
+	}
+}
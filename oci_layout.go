@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/registry"
+)
+
+const (
+	OCI_LAYOUT_FILE         = "oci-layout"
+	OCI_INDEX_FILE          = "index.json"
+	OCI_LAYOUT_VERSION      = "1.0.0"
+	OCI_REF_NAME_ANNOTATION = "org.opencontainers.image.ref.name"
+)
+
+var ErrNotOCILayout = fmt.Errorf("not an OCI image layout")
+
+//OCI image layout directory: blobs stored by digest in blobs/<algorithm>/<hex> and index.json pointing to the
+//manifests, named by their ref name annotation
+type ociLayout struct {
+	Root string
+}
+
+//open the layout in root, it's created if it doesn't exist and create is set
+func openOCILayout(root string, create bool) (*ociLayout, error) {
+	l := &ociLayout{Root: root}
+	rawLayout, err := ioutil.ReadFile(filepath.Join(root, OCI_LAYOUT_FILE))
+	if err == nil {
+		var layout struct {
+			ImageLayoutVersion string `json:"imageLayoutVersion"`
+		}
+		if err := json.Unmarshal(rawLayout, &layout); err != nil || layout.ImageLayoutVersion == "" {
+			return nil, fmt.Errorf("%v: invalid %v file", root, OCI_LAYOUT_FILE)
+		}
+		return l, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !create {
+		return nil, fmt.Errorf("%v: %v", root, ErrNotOCILayout)
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "blobs"), 0755); err != nil {
+		return nil, err
+	}
+	if err := l.writeIndex(&manifestList{SchemaVersion: 2, MediaType: MEDIATYPE_OCI_INDEX, Manifests: []descriptor{}}); err != nil {
+		return nil, err
+	}
+	rawLayout, _ = json.Marshal(map[string]string{"imageLayoutVersion": OCI_LAYOUT_VERSION})
+	return l, ioutil.WriteFile(filepath.Join(root, OCI_LAYOUT_FILE), rawLayout, 0644)
+}
+
+func (l *ociLayout) blobPath(digest string) (string, error) {
+	if !isDigest(digest) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	parts := strings.SplitN(digest, ":", 2)
+	return filepath.Join(l.Root, "blobs", parts[0], parts[1]), nil
+}
+
+//return whether the blob of desc is in the layout (size isn't checked if unknown)
+func (l *ociLayout) hasBlob(desc descriptor) bool {
+	p, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(p)
+	return err == nil && (desc.Size <= 0 || fi.Size() == desc.Size)
+}
+
+//store the blob read from r, it must match digest. Blobs show up in the layout once complete
+func (l *ociLayout) putBlob(digest string, r io.Reader) error {
+	p, err := l.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	dr, err := newDigestReader(r, strings.SplitN(digest, ":", 2)[0])
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = io.Copy(f, dr)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if computed := dr.Sum(nil); computed != digest {
+		return digestMismatchError(digest, computed)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+//content of a blob, verified against its digest
+func (l *ociLayout) readBlob(digest string) ([]byte, error) {
+	p, err := l.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, withExitCode(EXIT_NOT_FOUND, fmt.Errorf("blob %v is not in the OCI layout %v", digest, l.Root))
+	}
+	if err != nil {
+		return nil, err
+	}
+	computed, err := computeDigest(strings.SplitN(digest, ":", 2)[0], content)
+	if err != nil {
+		return nil, err
+	}
+	if computed != digest {
+		return nil, digestMismatchError(digest, computed)
+	}
+	return content, nil
+}
+
+func (l *ociLayout) readIndex() (*manifestList, error) {
+	rawIndex, err := ioutil.ReadFile(filepath.Join(l.Root, OCI_INDEX_FILE))
+	if err != nil {
+		return nil, err
+	}
+	var index manifestList
+	if err := json.Unmarshal(rawIndex, &index); err != nil {
+		return nil, fmt.Errorf("invalid %v: %v", OCI_INDEX_FILE, err)
+	}
+	return &index, nil
+}
+
+func (l *ociLayout) writeIndex(index *manifestList) error {
+	rawIndex, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(l.Root, "."+OCI_INDEX_FILE)
+	if err := ioutil.WriteFile(tmp, rawIndex, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(l.Root, OCI_INDEX_FILE))
+}
+
+//add desc to index.json, named refName if not empty. It replaces the manifest previously named refName
+func (l *ociLayout) tag(desc descriptor, refName string) error {
+	index, err := l.readIndex()
+	if err != nil {
+		return err
+	}
+	if refName != "" {
+		desc.Annotations = map[string]string{OCI_REF_NAME_ANNOTATION: refName}
+	}
+	manifests := []descriptor{}
+	for _, m := range index.Manifests {
+		name := m.Annotations[OCI_REF_NAME_ANNOTATION]
+		if (refName != "" && name == refName) || (name == "" && m.Digest == desc.Digest) {
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	index.Manifests = append(manifests, desc)
+	return l.writeIndex(index)
+}
+
+//descriptor of the manifest named refName in index.json. The manifest of an index with a single one is
+//returned whatever refName
+func (l *ociLayout) resolve(refName string) (*descriptor, error) {
+	index, err := l.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i, m := range index.Manifests {
+		name := m.Annotations[OCI_REF_NAME_ANNOTATION]
+		if name == refName {
+			return &index.Manifests[i], nil
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(index.Manifests) == 1 {
+		return &index.Manifests[0], nil
+	}
+	sort.Strings(names)
+	return nil, withExitCode(EXIT_NOT_FOUND, fmt.Errorf("no manifest named %v in the OCI layout %v (available: %v)", refName, l.Root, strings.Join(names, ", ")))
+}
+
+//krgo pull image --oci-layout dir
+//store manifests, config and layers of the image as is in the OCI layout dir, nothing is applied. Manifest lists
+//are resolved to the manifest of platform p (host platform if nil) unless allPlatforms is set
+func (s *registrySession) pullOCILayout(imageName, reference, dir string, p *platform, allPlatforms bool) error {
+	layout, err := openOCILayout(dir, true)
+	if err != nil {
+		return err
+	}
+	endpoint, auth, err := s.v2EndpointAndAuth(imageName)
+	if err != nil {
+		return err
+	}
+	rawManifest, mediaType, err := s.getVerifiedV2Manifest(endpoint, auth, imageName, reference)
+	if err != nil {
+		return err
+	}
+	desc, err := newManifestDescriptor(rawManifest, mediaType, reference)
+	if err != nil {
+		return err
+	}
+
+	if !isManifestList(mediaType) {
+		err = s.pullOCIImage(layout, endpoint, auth, imageName, rawManifest, mediaType, desc.Digest)
+	} else {
+		var list *manifestList
+		if list, err = parseManifestList(rawManifest); err != nil {
+			return err
+		}
+		manifests := list.Manifests
+		if !allPlatforms {
+			if p == nil {
+				p = hostPlatform()
+			}
+			m, err := list.selectPlatform(p)
+			if err != nil {
+				return err
+			}
+			printf("Multi platform image, selected %v (%v)\n", m.Platform, m.Digest)
+			manifests = []descriptor{*m}
+			s.report.Platform = m.Platform.String()
+		}
+		for _, m := range manifests {
+			if allPlatforms {
+				printf("Pulling platform %v (%v)\n", m.Platform, m.Digest)
+			}
+			rawImageManifest, imageMediaType, err := s.getVerifiedV2Manifest(endpoint, auth, imageName, m.Digest)
+			if err != nil {
+				return err
+			}
+			if err := s.pullOCIImage(layout, endpoint, auth, imageName, rawImageManifest, imageMediaType, m.Digest); err != nil {
+				return err
+			}
+		}
+		if allPlatforms {
+			s.report.ImageID = ""
+			err = layout.putBlob(desc.Digest, bytes.NewReader(rawManifest))
+		} else {
+			//the layout only has the selected platform, it's named instead of the list
+			desc = manifests[0]
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	refName := reference
+	if isDigest(reference) {
+		refName = ""
+	}
+	s.report.Digest = desc.Digest
+	printf("Manifest %v stored in %v\n", desc.Digest, dir)
+	return layout.tag(desc, refName)
+}
+
+//store an image manifest with its config and layers. Layers already in the layout aren't downloaded again
+func (s *registrySession) pullOCIImage(layout *ociLayout, endpoint *registry.Endpoint, auth *registry.RequestAuthorization, imageName string, rawManifest []byte, mediaType, digest string) (err error) {
+	manifest, err := parseManifest(rawManifest, mediaType)
+	if err != nil {
+		return err
+	}
+	if manifest.Config == nil {
+		return fmt.Errorf("%v manifests can't be stored in an OCI layout, only schema2 and OCI ones", manifest.MediaType)
+	}
+	if !layout.hasBlob(*manifest.Config) {
+		config, err := s.getV2ConfigBlob(endpoint, auth, imageName, manifest.Config.Digest)
+		if err != nil {
+			return err
+		}
+		if err := layout.putBlob(manifest.Config.Digest, bytes.NewReader(config)); err != nil {
+			return err
+		}
+	}
+	s.report.ImageID = manifest.Config.Digest
+
+	queue := s.newQueue()
+	defer func() {
+		if err != nil {
+			cancelDownloads(queue)
+		}
+	}()
+	defer queue.Progress.stop()
+
+	printf("Pulling %d layers:\n", len(manifest.Layers))
+	var downloads []descriptor
+	for _, layer := range uniqueLayers(manifest.Layers) {
+		if layout.hasBlob(layer) {
+			s.report.addLayer(&layerReport{ID: strings.SplitN(layer.Digest, ":", 2)[1], Digest: layer.Digest, Size: layer.Size, Cached: true})
+			printf("\t%v already in the layout\n", layer.Digest)
+			continue
+		}
+		queue.Enqueue(NewPullingV2Job(s, endpoint, auth, imageName, layer.Digest, layer.Size))
+		downloads = append(downloads, layer)
+	}
+	for _, layer := range downloads {
+		j, err := queue.WaitJob(layer.Digest)
+		if err != nil {
+			return err
+		}
+		job := j.(*PullingV2Job)
+		//layers are verified by the job, and again by the layout as blobs are addressed by content
+		err = layout.putBlob(layer.Digest, job.LayerDataReader)
+		job.LayerDataReader.Close()
+		if err != nil {
+			return err
+		}
+		s.report.addLayer(&layerReport{ID: strings.SplitN(layer.Digest, ":", 2)[1], Digest: layer.Digest, Size: job.LayerSize, Cached: job.CacheHit})
+		printf("\t%s (%.2f MB) stored\n", layer.Digest, float64(job.LayerSize)/ONE_MB)
+	}
+	return layout.putBlob(digest, bytes.NewReader(rawManifest))
+}
+
+//descriptor of a manifest fetched by reference
+func newManifestDescriptor(rawManifest []byte, mediaType, reference string) (descriptor, error) {
+	digest := reference
+	if !isDigest(reference) {
+		var err error
+		if digest, err = computeDigest("sha256", rawManifest); err != nil {
+			return descriptor{}, err
+		}
+	}
+	return descriptor{MediaType: mediaType, Size: int64(len(rawManifest)), Digest: digest}, nil
+}
+
+//manifest read from an OCI layout
+type layoutManifest struct {
+	Descriptor descriptor
+	MediaType  string
+	Raw        []byte
+}
+
+//krgo push image --from-oci dir
+//push the manifest named imageTag in the OCI layout dir (or its only manifest) as is: missing blobs are uploaded
+//concurrently, then manifests are put, the tagged one last
+func (s *registrySession) pushOCILayout(imageName, imageTag, dir string) error {
+	layout, err := openOCILayout(dir, false)
+	if err != nil {
+		return err
+	}
+	desc, err := layout.resolve(imageTag)
+	if err != nil {
+		return err
+	}
+	top, err := layout.readManifest(*desc)
+	if err != nil {
+		return err
+	}
+
+	//manifests of indexes are put before the index
+	manifests := []*layoutManifest{top}
+	if isManifestList(top.MediaType) {
+		list, err := parseManifestList(top.Raw)
+		if err != nil {
+			return err
+		}
+		manifests = nil
+		for _, m := range list.Manifests {
+			child, err := layout.readManifest(m)
+			if err != nil {
+				return err
+			}
+			manifests = append(manifests, child)
+		}
+		manifests = append(manifests, top)
+	}
+
+	var blobs []*layerBlob
+	found := make(map[string]bool)
+	configs := make(map[string]bool)
+	for _, m := range manifests {
+		if isManifestList(m.MediaType) {
+			continue
+		}
+		manifest, err := parseManifest(m.Raw, m.MediaType)
+		if err != nil {
+			return err
+		}
+		if manifest.Config == nil {
+			return fmt.Errorf("unexpected %v manifest in the OCI layout", manifest.MediaType)
+		}
+		s.report.ImageID = manifest.Config.Digest
+		configs[manifest.Config.Digest] = true
+		for _, d := range append([]descriptor{*manifest.Config}, manifest.Layers...) {
+			if found[d.Digest] {
+				continue
+			}
+			found[d.Digest] = true
+			if !layout.hasBlob(d) {
+				return withExitCode(EXIT_NOT_FOUND, fmt.Errorf("blob %v is not in the OCI layout %v", d.Digest, dir))
+			}
+			p, _ := layout.blobPath(d.Digest)
+			blobs = append(blobs, &layerBlob{BlobSum: d.Digest, SpoolPath: p})
+		}
+	}
+
+	endpoint, err := s.V2RegistryEndpoint(s.indexInfo)
+	if err != nil {
+		return err
+	}
+	auth, err := s.GetV2Authorization(endpoint, imageName, false)
+	if err != nil {
+		return err
+	}
+	printf("Registry endpoint: %v\n", endpoint)
+
+	printf("Pushing %d blobs:\n", len(blobs))
+	queue := s.newQueue()
+	defer queue.Progress.stop()
+	for _, blob := range blobs {
+		queue.Enqueue(NewPushingV2Job(s, endpoint, auth, imageName, blob))
+	}
+	for _, blob := range blobs {
+		j, err := queue.WaitJob(blob.BlobSum)
+		if err != nil {
+			queue.Cancel()
+			queue.Wait()
+			return err
+		}
+		job := j.(*PushingV2Job)
+		if job.AlreadyPushed {
+			printf("\t%v ... done (already pushed)\n", blob)
+		} else {
+			printf("\t%v ... done\n", blob)
+		}
+		if !configs[blob.BlobSum] {
+			s.report.addLayer(&layerReport{ID: strings.SplitN(blob.BlobSum, ":", 2)[1], Digest: blob.BlobSum, Size: job.Progress().Total(), AlreadyPushed: job.AlreadyPushed})
+		}
+	}
+
+	//every blob is in the registry
+	for _, m := range manifests {
+		reference := m.Descriptor.Digest
+		if m == top {
+			reference = imageTag
+		}
+		printf("Pushing manifest %v:%v\n", imageName, reference)
+		if err := s.putV2Manifest(endpoint, auth, imageName, reference, m.MediaType, m.Raw); err != nil {
+			return err
+		}
+	}
+	s.report.Digest = top.Descriptor.Digest
+	return nil
+}
+
+func (l *ociLayout) readManifest(desc descriptor) (*layoutManifest, error) {
+	raw, err := l.readBlob(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	mediaType := desc.MediaType
+	if mediaType == "" {
+		mediaType = manifestMediaType(raw, "")
+	}
+	return &layoutManifest{Descriptor: desc, MediaType: mediaType, Raw: raw}, nil
+}
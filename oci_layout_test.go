@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOCILayoutBlobs(t *testing.T) {
+	fmt.Printf("Testing OCI layout blobs ... ")
+	dir, err := ioutil.TempDir("", "krgo_test_oci_")
+	asserErrNil(err, t)
+	defer os.RemoveAll(dir)
+
+	if _, err := openOCILayout(dir, false); err == nil {
+		t.Fatal("expected an error opening a directory that isn't a layout")
+	}
+	layout, err := openOCILayout(dir, true)
+	asserErrNil(err, t)
+	for _, file := range []string{OCI_LAYOUT_FILE, OCI_INDEX_FILE} {
+		if !fileExists(filepath.Join(dir, file)) {
+			t.Fatalf("expected %v to be created", file)
+		}
+	}
+	_, err = openOCILayout(dir, false)
+	asserErrNil(err, t)
+
+	content := []byte("blob content")
+	digest, _ := computeDigest("sha256", content)
+	asserErrNil(layout.putBlob(digest, bytes.NewReader(content)), t)
+	if !layout.hasBlob(descriptor{Digest: digest, Size: int64(len(content))}) || layout.hasBlob(descriptor{Digest: digest, Size: 1}) {
+		t.Fatal("unexpected hasBlob result")
+	}
+	read, err := layout.readBlob(digest)
+	asserErrNil(err, t)
+	if !bytes.Equal(read, content) {
+		t.Fatalf("expected %q got %q", content, read)
+	}
+
+	//blobs are addressed by content
+	otherDigest, _ := computeDigest("sha256", []byte("other"))
+	if err := layout.putBlob(otherDigest, bytes.NewReader(content)); err == nil || exitCode(err) != EXIT_VERIFICATION {
+		t.Fatalf("expected a verification error got %v", err)
+	}
+	if layout.hasBlob(descriptor{Digest: otherDigest}) {
+		t.Fatal("a blob not matching its digest was stored")
+	}
+	if _, err := layout.readBlob(otherDigest); exitCode(err) != EXIT_NOT_FOUND {
+		t.Fatalf("expected a not found error got %v", err)
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestOCILayoutIndex(t *testing.T) {
+	fmt.Printf("Testing OCI layout index ... ")
+	dir, err := ioutil.TempDir("", "krgo_test_oci_")
+	asserErrNil(err, t)
+	defer os.RemoveAll(dir)
+	layout, err := openOCILayout(dir, true)
+	asserErrNil(err, t)
+
+	first := descriptor{MediaType: MEDIATYPE_OCI_MANIFEST, Digest: "sha256:" + fmt.Sprintf("%064d", 1), Size: 10}
+	second := descriptor{MediaType: MEDIATYPE_OCI_MANIFEST, Digest: "sha256:" + fmt.Sprintf("%064d", 2), Size: 20}
+
+	asserErrNil(layout.tag(first, "1.0"), t)
+	//a single manifest is used whatever the name
+	desc, err := layout.resolve("latest")
+	asserErrNil(err, t)
+	if desc.Digest != first.Digest {
+		t.Fatalf("expected %v got %v", first.Digest, desc.Digest)
+	}
+
+	asserErrNil(layout.tag(second, "latest"), t)
+	asserErrNil(layout.tag(second, "1.0"), t) //1.0 now names the second manifest
+	index, err := layout.readIndex()
+	asserErrNil(err, t)
+	if len(index.Manifests) != 2 || index.MediaType != MEDIATYPE_OCI_INDEX {
+		t.Fatalf("unexpected index %+v", index)
+	}
+	for _, name := range []string{"latest", "1.0"} {
+		desc, err := layout.resolve(name)
+		asserErrNil(err, t)
+		if desc.Digest != second.Digest || desc.Annotations[OCI_REF_NAME_ANNOTATION] != name {
+			t.Fatalf("%v: unexpected descriptor %+v", name, desc)
+		}
+	}
+	if _, err := layout.resolve("2.0"); err == nil || exitCode(err) != EXIT_NOT_FOUND {
+		t.Fatalf("expected a not found error got %v", err)
+	}
+	fmt.Printf("OK\n")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+//platform an image runs on, as found in manifest lists and OCI indexes
+type platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+//platform format: <os>/<architecture>[/<variant>]
+func parsePlatform(s string) (*platform, error) {
+	comps := strings.Split(strings.ToLower(s), "/")
+	if len(comps) < 2 || len(comps) > 3 || comps[0] == "" || comps[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q (format: os/architecture[/variant])", s)
+	}
+	p := &platform{OS: comps[0], Architecture: comps[1]}
+	if len(comps) == 3 {
+		p.Variant = comps[2]
+	}
+	return p.normalize(), nil
+}
+
+//platform krgo is running on
+func hostPlatform() *platform {
+	p := &platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if p.Architecture == "arm" {
+		p.Variant = "v7"
+	}
+	return p.normalize()
+}
+
+//platform of an image config (or V1 image json), nil if it doesn't tell
+func configPlatform(rawConfig []byte) *platform {
+	p := &platform{}
+	if err := json.Unmarshal(rawConfig, p); err != nil || p.OS == "" || p.Architecture == "" {
+		return nil
+	}
+	return p.normalize()
+}
+
+//whether the image of platform pulled satisfies the requested p. Unknown platforms always do, and so do
+//missing variants since configs often don't tell them
+func platformMatches(p, pulled *platform) bool {
+	if p == nil || pulled == nil {
+		return true
+	}
+	want := (&platform{OS: p.OS, Architecture: p.Architecture, Variant: p.Variant}).normalize()
+	if pulled.Variant == "" {
+		want.Variant = ""
+	}
+	return want.matches(pulled)
+}
+
+//use the names of the OCI image spec (uname like names are accepted)
+func (p *platform) normalize() *platform {
+	switch p.Architecture {
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armhf":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armel":
+		p.Architecture, p.Variant = "arm", "v6"
+	case "i386", "i686":
+		p.Architecture = "386"
+	}
+	if p.Architecture == "arm64" && p.Variant == "v8" {
+		p.Variant = ""
+	}
+	return p
+}
+
+//return whether other satisfies p. An empty variant matches any variant
+func (p *platform) matches(other *platform) bool {
+	if other == nil {
+		return false
+	}
+	o := (&platform{OS: other.OS, Architecture: other.Architecture, Variant: other.Variant}).normalize()
+	return p.OS == o.OS && p.Architecture == o.Architecture && (p.Variant == "" || p.Variant == o.Variant)
+}
+
+func (p *platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+//suffix of the rootfs directory a platform is pulled in with --all-platforms
+func (p *platform) dirSuffix() string {
+	return "_" + strings.Replace(p.String(), "/", "_", -1)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+const manifestListRaw = `{
+   "schemaVersion": 2,
+   "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+   "manifests": [
+      {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "size": 527, "digest": "sha256:amd64", "platform": {"architecture": "amd64", "os": "linux"}},
+      {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "size": 527, "digest": "sha256:armv6", "platform": {"architecture": "arm", "os": "linux", "variant": "v6"}},
+      {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "size": 527, "digest": "sha256:armv7", "platform": {"architecture": "arm", "os": "linux", "variant": "v7"}},
+      {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "size": 527, "digest": "sha256:arm64", "platform": {"architecture": "arm64", "os": "linux", "variant": "v8"}},
+      {"mediaType": "application/vnd.oci.image.manifest.v1+json", "size": 566, "digest": "sha256:attestation", "platform": {"architecture": "unknown", "os": "unknown"}, "annotations": {"vnd.docker.reference.digest": "sha256:amd64", "vnd.docker.reference.type": "attestation-manifest"}},
+      {"mediaType": "application/vnd.oci.image.manifest.v1+json", "size": 566, "digest": "sha256:annotated", "platform": {"architecture": "amd64", "os": "linux"}, "annotations": {"vnd.docker.reference.type": "attestation-manifest"}}
+   ]
+}`
+
+func TestSelectPlatform(t *testing.T) {
+	fmt.Printf("Testing manifest list platform selection ... ")
+	if mt := manifestMediaType([]byte(manifestListRaw), ""); !isManifestList(mt) {
+		t.Fatalf("expected a manifest list got %v", mt)
+	}
+	list, err := parseManifestList([]byte(manifestListRaw))
+	asserErrNil(err, t)
+
+	expected := map[string]string{
+		"linux/amd64":    "sha256:amd64",
+		"linux/x86_64":   "sha256:amd64",
+		"linux/arm64":    "sha256:arm64",
+		"linux/aarch64":  "sha256:arm64",
+		"linux/arm64/v8": "sha256:arm64",
+		"linux/arm/v7":   "sha256:armv7",
+		"linux/arm":      "sha256:armv6",
+	}
+	for s, digest := range expected {
+		p, err := parsePlatform(s)
+		asserErrNil(err, t)
+		m, err := list.selectPlatform(p)
+		asserErrNil(err, t)
+		if m.Digest != digest {
+			t.Fatalf("%v: got %v expected %v", s, m.Digest, digest)
+		}
+	}
+
+	p, _ := parsePlatform("windows/amd64")
+	if _, err := list.selectPlatform(p); err == nil {
+		t.Fatal("expected no image for windows/amd64")
+	}
+
+	//attestation manifests aren't images
+	images := list.images()
+	if len(images) != 4 {
+		t.Fatalf("expected 4 images got %d", len(images))
+	}
+	for _, m := range images {
+		if m.Digest == "sha256:attestation" || m.Digest == "sha256:annotated" {
+			t.Fatalf("attestation manifest %v listed as an image", m.Digest)
+		}
+	}
+	p, _ = parsePlatform("unknown/unknown")
+	if _, err := list.selectPlatform(p); err == nil {
+		t.Fatal("expected no image for unknown/unknown")
+	}
+
+	//platform of single platform images
+	if cp := configPlatform([]byte(`{"architecture": "aarch64", "os": "linux", "config": {}}`)); cp == nil || cp.String() != "linux/arm64" {
+		t.Fatalf("expected linux/arm64 got %v", cp)
+	}
+	if cp := configPlatform([]byte(`{"id": "abc"}`)); cp != nil {
+		t.Fatalf("expected no platform got %v", cp)
+	}
+	arm64 := configPlatform([]byte(`{"architecture": "arm64", "os": "linux"}`))
+	for s, matches := range map[string]bool{"linux/arm64": true, "linux/arm64/v8": true, "linux/amd64": false, "windows/arm64": false} {
+		p, _ := parsePlatform(s)
+		if platformMatches(p, arm64) != matches {
+			t.Fatalf("%v: expected match %v with %v", s, matches, arm64)
+		}
+	}
+	armv7 := &platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	if p, _ := parsePlatform("linux/arm/v6"); platformMatches(p, armv7) || !platformMatches(p, &platform{OS: "linux", Architecture: "arm"}) {
+		t.Fatal("expected variants to be compared only when the config tells it")
+	}
+	for _, s := range []string{"linux", "linux/", "/amd64", "linux/arm/v7/extra"} {
+		if _, err := parsePlatform(s); err == nil {
+			t.Fatalf("%v: expected an invalid platform error", s)
+		}
+	}
+	fmt.Printf("OK\n")
+}
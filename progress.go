@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/pkg/term"
+)
+
+const (
+	TTY_REFRESH_INTERVAL   = 200 * time.Millisecond
+	PLAIN_REFRESH_INTERVAL = 5 * time.Second
+	EVENTS_INTERVAL        = time.Second
+	PROGRESS_BAR_WIDTH     = 30
+)
+
+//jobs transferring data report it through their transferProgress
+type ProgressReporter interface {
+	Progress() *transferProgress
+}
+
+//bytes transferred by a job, updated by the job and read by the progress display
+type transferProgress struct {
+	ID      string
+	current int64
+	total   int64 //0 if unknown
+	done    int32
+	skipped atomic.Value //why nothing was transferred (cached, already pushed), empty otherwise
+}
+
+func newTransferProgress(id string) *transferProgress {
+	return &transferProgress{ID: id}
+}
+
+func (p *transferProgress) add(n int64)      { atomic.AddInt64(&p.current, n) }
+func (p *transferProgress) set(n int64)      { atomic.StoreInt64(&p.current, n) }
+func (p *transferProgress) setTotal(n int64) { atomic.StoreInt64(&p.total, n) }
+func (p *transferProgress) Current() int64   { return atomic.LoadInt64(&p.current) }
+func (p *transferProgress) Total() int64     { return atomic.LoadInt64(&p.total) }
+func (p *transferProgress) finish()          { atomic.StoreInt32(&p.done, 1) }
+func (p *transferProgress) Done() bool       { return atomic.LoadInt32(&p.done) == 1 }
+
+//nothing had to be transferred, note tells why
+func (p *transferProgress) skip(n int64, note string) {
+	p.setTotal(n)
+	p.set(n)
+	p.skipped.Store(note)
+	p.finish()
+}
+
+func (p *transferProgress) Skipped() string {
+	note, _ := p.skipped.Load().(string)
+	return note
+}
+
+type transferProgressKey struct{}
+
+//attach p to ctx, bytes read through a ctxReader with ctx are accounted to it
+func withProgress(ctx context.Context, p *transferProgress) context.Context {
+	return context.WithValue(ctx, transferProgressKey{}, p)
+}
+
+//progress attached to ctx, nil if none
+func progressFrom(ctx context.Context) *transferProgress {
+	p, _ := ctx.Value(transferProgressKey{}).(*transferProgress)
+	return p
+}
+
+//user facing output. Messages printed while a progress display is running are written above it
+type console struct {
+	lock    sync.Mutex
+	w       io.Writer
+	tty     bool
+	display *progressDisplay //running display, nil if none
+}
+
+var stdout = &console{w: os.Stdout, tty: term.IsTerminal(os.Stdout.Fd())}
+
+func printf(format string, a ...interface{}) {
+	stdout.Printf(format, a...)
+}
+
+func (c *console) Printf(format string, a ...interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.display != nil {
+		c.display.clear()
+		defer c.display.draw()
+	}
+	fmt.Fprintf(c.w, format, a...)
+}
+
+//live view of the transfers of a queue: per layer bars with total throughput and ETA on a terminal, periodic
+//plain text lines otherwise. Progress events are emitted as json if events is not nil
+type progressDisplay struct {
+	console   *console
+	events    *jsonOutput
+	transfers []*transferProgress
+	start     time.Time
+	drawn     int //lines drawn on the terminal
+	lastPlain time.Time
+	emitted   map[*transferProgress]progressEvent
+	stopChan  chan bool
+	doneChan  chan bool
+}
+
+//start displaying transfers on c, events may be nil
+func startProgressDisplay(c *console, events *jsonOutput) *progressDisplay {
+	now := time.Now()
+	d := &progressDisplay{
+		console:   c,
+		events:    events,
+		start:     now,
+		lastPlain: now,
+		emitted:   make(map[*transferProgress]progressEvent),
+		stopChan:  make(chan bool),
+		doneChan:  make(chan bool),
+	}
+	c.lock.Lock()
+	c.display = d
+	c.lock.Unlock()
+
+	interval := PLAIN_REFRESH_INTERVAL
+	if c.tty {
+		interval = TTY_REFRESH_INTERVAL
+	} else if events != nil {
+		interval = EVENTS_INTERVAL
+	}
+	go func() {
+		defer close(d.doneChan)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.refresh(false)
+			case <-d.stopChan:
+				return
+			}
+		}
+	}()
+	return d
+}
+
+func (d *progressDisplay) track(p *transferProgress) {
+	d.console.lock.Lock()
+	defer d.console.lock.Unlock()
+	d.transfers = append(d.transfers, p)
+}
+
+//stop the display, the final state stays on the terminal. Safe to call on a nil display
+func (d *progressDisplay) stop() {
+	if d == nil {
+		return
+	}
+	close(d.stopChan)
+	<-d.doneChan
+	d.refresh(true)
+	d.console.lock.Lock()
+	d.console.display = nil
+	d.drawn = 0
+	d.console.lock.Unlock()
+}
+
+func (d *progressDisplay) refresh(final bool) {
+	d.console.lock.Lock()
+	defer d.console.lock.Unlock()
+	if d.console.tty {
+		d.clear()
+		d.draw()
+	} else if len(d.transfers) > 0 && (final || time.Since(d.lastPlain) >= PLAIN_REFRESH_INTERVAL) {
+		fmt.Fprintf(d.console.w, "%s\n", d.summary())
+		d.lastPlain = time.Now()
+	}
+	if d.events != nil {
+		d.emitEvents()
+	}
+}
+
+//emit an event for every transfer that progressed since the last one, must be called with the console lock held
+func (d *progressDisplay) emitEvents() {
+	for _, p := range d.transfers {
+		e := progressEvent{Event: "progress", ID: p.ID, Current: p.Current(), Total: p.Total(), Note: p.Skipped()}
+		if p.Done() {
+			e.Event = "done"
+		}
+		if last, ok := d.emitted[p]; ok && last.Event == e.Event && last.Current == e.Current && last.Total == e.Total {
+			continue
+		}
+		d.emitted[p] = e
+		e.Time = time.Now().UTC()
+		d.events.emit(e)
+	}
+}
+
+//erase the drawn bars, must be called with the console lock held
+func (d *progressDisplay) clear() {
+	if d.drawn > 0 {
+		//move up and clear to the end of the screen
+		fmt.Fprintf(d.console.w, "\033[%dA\033[J", d.drawn)
+		d.drawn = 0
+	}
+}
+
+//draw the bars (terminal only), must be called with the console lock held
+func (d *progressDisplay) draw() {
+	if !d.console.tty || len(d.transfers) == 0 {
+		return
+	}
+	for _, p := range d.transfers {
+		fmt.Fprintf(d.console.w, "%s\n", progressBar(p))
+	}
+	fmt.Fprintf(d.console.w, "%s\n", d.summary())
+	d.drawn = len(d.transfers) + 1
+}
+
+//overall progress: layers done, bytes, throughput and ETA
+func (d *progressDisplay) summary() string {
+	var current, total, transferred int64
+	done, unknownTotal := 0, false
+	for _, p := range d.transfers {
+		current += p.Current()
+		total += p.Total()
+		if p.Skipped() == "" {
+			transferred += p.Current()
+		}
+		if p.Total() == 0 {
+			unknownTotal = true
+		}
+		if p.Done() {
+			done++
+		}
+	}
+	elapsed := time.Since(d.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(transferred) / elapsed
+	}
+	s := fmt.Sprintf("%d/%d layers, %.2f/%.2f MB, %.2f MB/s", done, len(d.transfers), float64(current)/ONE_MB, float64(total)/ONE_MB, rate/ONE_MB)
+	if done < len(d.transfers) && !unknownTotal {
+		s += ", ETA " + eta(total-current, rate)
+	}
+	return s
+}
+
+func progressBar(p *transferProgress) string {
+	id := p.ID
+	if i := strings.Index(id, ":"); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	switch {
+	case p.Skipped() != "":
+		return fmt.Sprintf("%s %s", id, p.Skipped())
+	case p.Total() <= 0:
+		return fmt.Sprintf("%s %.2f MB", id, float64(p.Current())/ONE_MB)
+	}
+	filled := int(float64(PROGRESS_BAR_WIDTH) * float64(p.Current()) / float64(p.Total()))
+	if filled > PROGRESS_BAR_WIDTH {
+		filled = PROGRESS_BAR_WIDTH
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < PROGRESS_BAR_WIDTH {
+		bar += ">" + strings.Repeat(" ", PROGRESS_BAR_WIDTH-filled-1)
+	}
+	status := fmt.Sprintf("%.2f/%.2f MB", float64(p.Current())/ONE_MB, float64(p.Total())/ONE_MB)
+	if p.Done() {
+		status += " done"
+	}
+	return fmt.Sprintf("%s [%s] %s", id, bar, status)
+}
+
+//time left to transfer remaining bytes at rate bytes per second
+func eta(remaining int64, rate float64) string {
+	if rate <= 0 {
+		return "unknown"
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return (time.Duration(float64(remaining)/rate) * time.Second).String()
+}
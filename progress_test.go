@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestTransferProgress(t *testing.T) {
+	fmt.Printf("Testing transfer progress ... ")
+	p := newTransferProgress("sha256:0123456789abcdef")
+	p.setTotal(4 * ONE_MB)
+
+	//bytes read through a ctxReader are accounted
+	ctx := withProgress(context.Background(), p)
+	n, err := io.Copy(ioutil.Discard, &ctxReader{ctx, bytes.NewReader(make([]byte, ONE_MB))})
+	asserErrNil(err, t)
+	if n != ONE_MB || p.Current() != ONE_MB {
+		t.Fatalf("expected %d bytes accounted got %d", ONE_MB, p.Current())
+	}
+	if bar := progressBar(p); bar != "0123456789ab [=======>                      ] 1.00/4.00 MB" {
+		t.Fatalf("unexpected bar %q", bar)
+	}
+
+	cached := newTransferProgress("cached")
+	cached.skip(2*ONE_MB, "cached")
+	if !cached.Done() || progressBar(cached) != "cached cached" {
+		t.Fatalf("unexpected bar %q", progressBar(cached))
+	}
+
+	d := &progressDisplay{console: &console{w: ioutil.Discard}, transfers: []*transferProgress{p, cached}}
+	summary := d.summary()
+	if !strings.HasPrefix(summary, "1/2 layers, 3.00/6.00 MB") || !strings.Contains(summary, "ETA") {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestProgressDisplay(t *testing.T) {
+	fmt.Printf("Testing progress display ... ")
+	buf := &bytes.Buffer{}
+	c := &console{w: buf, tty: true}
+	d := startProgressDisplay(c, nil)
+	p := newTransferProgress("layer")
+	p.setTotal(ONE_MB)
+	d.track(p)
+
+	c.Printf("first\n")
+	c.Printf("second\n")
+	p.set(ONE_MB)
+	p.finish()
+	d.stop()
+
+	//bars are erased before messages and drawn again after them
+	out := buf.String()
+	if !strings.HasPrefix(out, "first\nlayer [") || !strings.Contains(out, "\033[2A\033[Jsecond\n") {
+		t.Fatalf("unexpected output %q", out)
+	}
+	final := out[strings.LastIndex(out, "\033[J")+len("\033[J"):]
+	if !strings.HasPrefix(final, "layer [==============================] 1.00/1.00 MB done\n1/1 layers, 1.00/1.00 MB, ") || !strings.HasSuffix(final, "MB/s\n") {
+		t.Fatalf("expected final state to stay on screen, got %q", out)
+	}
+
+	//plain output: summary lines only
+	buf.Reset()
+	c = &console{w: buf}
+	d = startProgressDisplay(c, nil)
+	d.track(p)
+	c.Printf("message\n")
+	d.stop()
+	if out := buf.String(); !strings.HasPrefix(out, "message\n1/1 layers") || strings.Contains(out, "\033") {
+		t.Fatalf("unexpected plain output %q", out)
+	}
+	fmt.Printf("OK\n")
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -10,10 +10,7 @@ import (
 	"github.com/docker/docker/pkg/archive"
 )
 
-const (
-	MAX_DL_CONCURRENCY = 7
-	ONE_MB             = 1000000
-)
+const ONE_MB = 1000000
 
 //krgo pull image -r rootfs
 //download a flattened docker image from the V1 registry
@@ -28,20 +25,28 @@ func (s *registrySession) pullRepository(imageName, imageTag, rootfsDest string)
 }
 
 //pulling using V1 registry
-func (s *registrySession) downloadImage(imageName, imageTag, rootfsDest string, gitLayering bool) error {
+func (s *registrySession) downloadImage(imageName, imageTag, rootfsDest string, gitLayering bool) (err error) {
 	repoData, err := s.GetRepositoryData(imageName)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Registry endpoint: %v\n", repoData.Endpoints)
+	printf("Registry endpoint: %v\n", repoData.Endpoints)
 
 	tagsList, err := s.GetRemoteTags(repoData.Endpoints, imageName, repoData.Tokens)
 	if err != nil {
 		return err
 	}
 
-	imageId := tagsList[imageTag]
-	fmt.Printf("Image ID: %v\n", imageId)
+	imageId, ok := tagsList[imageTag]
+	if !ok || imageId == "" {
+		tags := make([]string, 0, len(tagsList))
+		for tag := range tagsList {
+			tags = append(tags, tag)
+		}
+		return tagNotFoundError(imageName, imageTag, tags)
+	}
+	printf("Image ID: %v\n", imageId)
+	s.report.ImageID = imageId
 
 	//Download image history
 	var imageHistory []string
@@ -55,6 +60,19 @@ func (s *registrySession) downloadImage(imageName, imageTag, rootfsDest string,
 		return err
 	}
 
+	rootfsCreated := !fileExists(rootfsDest)
+	restorePoint, err := pullRestorePoint(rootfsDest, rootfsCreated, gitLayering)
+	if err != nil {
+		return err
+	}
+	queue := s.newQueue()
+	defer func() {
+		if err != nil {
+			abortPull(queue, rootfsDest, rootfsCreated, restorePoint)
+		}
+	}()
+	defer queue.Progress.stop()
+
 	err = os.MkdirAll(rootfsDest, 0700)
 	if err != nil {
 		return err
@@ -67,19 +85,19 @@ func (s *registrySession) downloadImage(imageName, imageTag, rootfsDest string,
 		}
 	}
 
-	queue := NewQueue(MAX_DL_CONCURRENCY)
-	fmt.Printf("Pulling %d layers:\n", len(imageHistory))
+	printf("Pulling %d layers:\n", len(imageHistory))
 
 	for i := len(imageHistory) - 1; i >= 0; i-- {
 		layerId := imageHistory[i]
 		job := NewPullingJob(s, repoData, layerId)
 		queue.Enqueue(job)
 	}
-	<-queue.DoneChan
 
-	fmt.Printf("Downloading layers:\n")
+	//layers are applied as soon as they and every layers below them are downloaded
+	printf("Applying layers:\n")
 
 	cpt := 0
+	cacheHits := 0
 
 	for i := len(imageHistory) - 1; i >= 0; i-- {
 
@@ -94,8 +112,14 @@ func (s *registrySession) downloadImage(imageName, imageTag, rootfsDest string,
 		}
 
 		//download and untar the layer
-		job := queue.CompletedJobWithID(layerID).(*PullingJob)
-		fmt.Printf("\t%s (%.2f MB) ... ", layerID, float64(job.LayerSize)/ONE_MB)
+		j, err := queue.WaitJob(layerID)
+		if err != nil {
+			return err
+		}
+		job := j.(*PullingJob)
+		if job.CacheHit {
+			cacheHits++
+		}
 		_, err = archive.ApplyLayer(rootfsDest, job.LayerData)
 		job.LayerData.Close()
 		if err != nil {
@@ -115,7 +139,47 @@ func (s *registrySession) downloadImage(imageName, imageTag, rootfsDest string,
 
 		cpt++
 
-		fmt.Printf("done\n")
+		s.report.addLayer(&layerReport{ID: layerID, Size: int64(job.LayerSize), Cached: job.CacheHit})
+		printf("\t%s (%.2f MB) applied\n", layerID, float64(job.LayerSize)/ONE_MB)
 	}
+	printf("%d/%d layers from the local cache\n", cacheHits, len(imageHistory))
 	return nil
 }
+
+//undo a failed pull: cancel pending downloads, release downloaded layers and remove the rootfs if the pull created it.
+//An existing git layered rootfs is reset to restorePoint if not nil
+func abortPull(queue *Queue, rootfsDest string, rootfsCreated bool, restorePoint *gitRestorePoint) {
+	cancelDownloads(queue)
+	switch {
+	case rootfsCreated:
+		printf("Pull failed, removing %v\n", rootfsDest)
+		os.RemoveAll(rootfsDest)
+	case restorePoint != nil:
+		if err := restorePoint.restore(); err != nil {
+			printf("Pull failed, %v may have been partially written (failed to reset it to %v: %v)\n", rootfsDest, restorePoint.head, err)
+		} else {
+			printf("Pull failed, %v reset to %v\n", rootfsDest, restorePoint.head)
+		}
+	default:
+		printf("Pull failed, %v may have been partially written\n", rootfsDest)
+	}
+}
+
+//restore point of an existing git layered rootfs, nil otherwise
+func pullRestorePoint(rootfsDest string, rootfsCreated, gitLayering bool) (*gitRestorePoint, error) {
+	if rootfsCreated || !gitLayering {
+		return nil, nil
+	}
+	return newGitRestorePoint(rootfsDest)
+}
+
+//cancel pending downloads and release downloaded layers
+func cancelDownloads(queue *Queue) {
+	queue.Cancel()
+	queue.Wait()
+	for _, job := range queue.CompletedJobs {
+		if closer, ok := job.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
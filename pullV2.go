@@ -1,10 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
 	"strings"
 
 	"github.com/docker/docker/pkg/archive"
@@ -12,38 +14,134 @@ import (
 )
 
 //krgo pull image -r rootfs -v2
-//download a flattened docker image from the V2 registry
-func (s *registrySession) pullImageV2(imageName, imageTag, rootfsDest string) error {
-	return s.downloadImageV2(imageName, imageTag, rootfsDest, false)
+//download a flattened docker image from the V2 registry. reference is either a tag or a digest,
+//p selects the image of multi platform images
+func (s *registrySession) pullImageV2(imageName, reference, rootfsDest string, p *platform) error {
+	return s.downloadImageV2(imageName, reference, rootfsDest, false, p)
 }
 
 //krgo pull image -r rootfs -g -v2
 //download a docker image from the V1 registry putting each layer in a git branch "on top of each other"
-func (s *registrySession) pullRepositoryV2(imageName, imageTag, rootfsDest string) error {
-	return s.downloadImageV2(imageName, imageTag, rootfsDest, true)
+func (s *registrySession) pullRepositoryV2(imageName, reference, rootfsDest string, p *platform) error {
+	return s.downloadImageV2(imageName, reference, rootfsDest, true, p)
 }
 
-//pulling using V2 registry (much nicer !)
-func (s *registrySession) downloadImageV2(imageName, imageTag, rootfsDest string, gitLayering bool) error {
-	endpoint, err := s.V2RegistryEndpoint(s.indexInfo)
+//krgo pull image -r rootfs --all-platforms
+//download every image of a multi platform image, each in rootfsDest_<os>_<architecture>[_<variant>]
+func (s *registrySession) pullAllPlatformsV2(imageName, reference, rootfsDest string, gitLayering bool) error {
+	endpoint, auth, err := s.v2EndpointAndAuth(imageName)
 	if err != nil {
 		return err
 	}
-	auth, err := s.GetV2Authorization(endpoint, imageName, true)
+	rawManifest, mediaType, err := s.getVerifiedV2Manifest(endpoint, auth, imageName, reference)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Registry endpoint: %v\n", endpoint)
+	if !isManifestList(mediaType) {
+		printf("%v:%v is not a multi platform image\n", imageName, reference)
+		return s.downloadImageV2(imageName, reference, rootfsDest, gitLayering, nil)
+	}
 
-	rawManifest, err := s.GetV2ImageManifest(endpoint, imageName, imageTag, auth)
+	list, err := parseManifestList(rawManifest)
 	if err != nil {
 		return err
 	}
+	if s.report.Digest, err = referenceDigest(rawManifest, reference); err != nil {
+		return err
+	}
+
+	//every platform is reported on its own
+	report := s.report
+	defer func() { s.report = report }()
+	for _, m := range list.images() {
+		dest := rootfsDest + m.Platform.dirSuffix()
+		printf("Pulling platform %v into %v\n", m.Platform, dest)
+		s.report = newTransferReport(report.Image, dest)
+		if err := s.downloadImageV2(imageName, m.Digest, dest, gitLayering, m.Platform); err != nil {
+			return err
+		}
+		s.report.finish()
+		report.Platforms = append(report.Platforms, s.report)
+		report.Size += s.report.Size
+	}
+	return nil
+}
+
+//pulling using V2 registry (much nicer !). Schema1, schema2 and OCI manifests are supported, as well as
+//manifest lists and OCI indexes: the manifest of platform p (host platform if nil) is pulled
+func (s *registrySession) downloadImageV2(imageName, reference, rootfsDest string, gitLayering bool, p *platform) (err error) {
+	endpoint, auth, err := s.v2EndpointAndAuth(imageName)
+	if err != nil {
+		return err
+	}
+
+	rawManifest, mediaType, err := s.getVerifiedV2Manifest(endpoint, auth, imageName, reference)
+	if err != nil {
+		return err
+	}
+
+	if isManifestList(mediaType) {
+		list, err := parseManifestList(rawManifest)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			p = hostPlatform()
+		}
+		m, err := list.selectPlatform(p)
+		if err != nil {
+			return err
+		}
+		if s.report.Digest, err = referenceDigest(rawManifest, reference); err != nil {
+			return err
+		}
+		printf("Multi platform image, selected %v (%v)\n", m.Platform, m.Digest)
+		return s.downloadImageV2(imageName, m.Digest, rootfsDest, gitLayering, p)
+	}
+
+	manifest, err := parseManifest(rawManifest, mediaType)
+	if err != nil {
+		return err
+	}
+	printf("Manifest type: %v\n", manifest.MediaType)
+	//digest of the image manifest, unless the one of the manifest list was already reported
+	if s.report.Digest == "" {
+		if s.report.Digest, err = referenceDigest(rawManifest, reference); err != nil {
+			return err
+		}
+	}
+
+	//image metadata: config blob for schema2 and OCI manifests, top layer json for schema1
+	imageConfig := manifest.V1Compat
+	if manifest.Config != nil {
+		if imageConfig, err = s.getV2ConfigBlob(endpoint, auth, imageName, manifest.Config.Digest); err != nil {
+			return err
+		}
+	}
 
-	var manifest registry.ManifestData
-	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+	//single platform images can't honor --platform, make sure it's the one asked for
+	pulled := configPlatform(imageConfig)
+	if !platformMatches(p, pulled) {
+		return withExitCode(EXIT_NOT_FOUND, fmt.Errorf("%v:%v is a single platform image for %v, not %v", imageName, reference, pulled, p))
+	}
+	if pulled != nil {
+		s.report.Platform = pulled.String()
+	} else if p != nil {
+		s.report.Platform = p.String()
+	}
+
+	rootfsCreated := !fileExists(rootfsDest)
+	restorePoint, err := pullRestorePoint(rootfsDest, rootfsCreated, gitLayering)
+	if err != nil {
 		return err
 	}
+	queue := s.newQueue()
+	defer func() {
+		if err != nil {
+			abortPull(queue, rootfsDest, rootfsCreated, restorePoint)
+		}
+	}()
+	defer queue.Progress.stop()
 
 	err = os.MkdirAll(rootfsDest, 0700)
 	if err != nil {
@@ -57,28 +155,28 @@ func (s *registrySession) downloadImageV2(imageName, imageTag, rootfsDest string
 		}
 	}
 
-	queue := NewQueue(MAX_DL_CONCURRENCY)
-	fmt.Printf("Manifest contains %d layers, try to cleanup ...\n", len(manifest.FSLayers))
-	cleanupManifest(&manifest)
-	fmt.Printf("Pulling %d layers:\n", len(manifest.FSLayers))
+	printf("Pulling %d layers:\n", len(manifest.Layers))
 
-	for i := len(manifest.FSLayers) - 1; i >= 0; i-- {
-		sumStr := manifest.FSLayers[i].BlobSum
-		job := NewPullingV2Job(s, endpoint, auth, imageName, sumStr)
+	lastUse := make(map[string]int)
+	for i, layer := range manifest.Layers {
+		lastUse[layer.Digest] = i
+	}
+	for _, layer := range uniqueLayers(manifest.Layers) {
+		job := NewPullingV2Job(s, endpoint, auth, imageName, layer.Digest, layer.Size)
 		queue.Enqueue(job)
 	}
-	<-queue.DoneChan
 
-	fmt.Printf("Downloading layers:\n")
-	cpt := 0
-	for i := len(manifest.FSLayers) - 1; i >= 0; i-- {
-		sumStr := manifest.FSLayers[i].BlobSum
+	//layers are applied as soon as they and every layers below them are downloaded
+	printf("Applying layers:\n")
+	cacheHits := 0
+	for i, layer := range manifest.Layers {
+		sumStr := layer.Digest
 		sumType := strings.Split(sumStr, ":")[0]
 		checksum := strings.Split(sumStr, ":")[1]
 
 		if gitLayering {
 			//create a git branch
-			br := newBranch(cpt, checksum)
+			br := newBranch(i, checksum)
 			if _, err = gitRepo.checkoutB(br); err != nil {
 				return err
 			}
@@ -88,14 +186,45 @@ func (s *registrySession) downloadImageV2(imageName, imageTag, rootfsDest string
 			}
 		}
 
-		job := queue.CompletedJobWithID(sumStr).(*PullingV2Job)
-		fmt.Printf("\t%s (%.2f MB) ... ", checksum, float64(job.LayerSize)/ONE_MB)
-		_, err = archive.ApplyLayer(rootfsDest, ioutil.NopCloser(job.LayerTarSumReader))
+		j, err := queue.WaitJob(sumStr)
 		if err != nil {
 			return err
 		}
-		finalChecksum := job.LayerTarSumReader.Sum(nil)
-		job.LayerDataReader.Close()
+		job := j.(*PullingV2Job)
+		if job.CacheHit {
+			cacheHits++
+		}
+		//layers are verified by the job before being applied
+		_, err = archive.ApplyLayer(rootfsDest, job.LayerDataReader)
+		if lastUse[sumStr] == i {
+			job.LayerDataReader.Close()
+		} else if err == nil {
+			//the layer is present again higher in the image, its data is applied again then
+			_, err = job.LayerDataReader.(io.Seeker).Seek(0, 0)
+		}
+		if err != nil {
+			return err
+		}
+
+		if i == len(manifest.Layers)-1 {
+			//image metadata goes with the top layer, like V1 pulls
+			parent := ""
+			if i > 0 {
+				parent = strings.Split(manifest.Layers[i-1].Digest, ":")[1]
+			}
+			jsonRaw, err := v1ImageJSON(imageConfig, checksum, parent)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path.Join(rootfsDest, "json"), jsonRaw, 0644); err != nil {
+				return err
+			}
+			//the config digest identifies schema2 and OCI images
+			s.report.ImageID = checksum
+			if manifest.Config != nil {
+				s.report.ImageID = manifest.Config.Digest
+			}
+		}
 
 		if gitLayering {
 			if _, err = gitRepo.addAllAndCommit("adding layer " + checksum); err != nil {
@@ -103,25 +232,65 @@ func (s *registrySession) downloadImageV2(imageName, imageTag, rootfsDest string
 			}
 		}
 
-		verified := strings.EqualFold(finalChecksum, sumStr)
-		fmt.Printf("done (tarsum verified: %v)\n", verified)
-
-		cpt++
+		s.report.addLayer(&layerReport{ID: checksum, Digest: sumStr, Size: job.LayerSize, Cached: job.CacheHit})
+		verification := "verified"
+		if !job.Verified {
+			verification = "verification skipped"
+		}
+		printf("\t%s (%.2f MB) applied (%s %s)\n", checksum, float64(job.LayerSize)/ONE_MB, sumType, verification)
 	}
+	printf("%d/%d layers from the local cache\n", cacheHits, len(manifest.Layers))
 	return nil
 }
 
-//Layers are now addressed by content, i.e identified by their tarsum (https://github.com/docker/docker-registry/issues/612)
-//v1 registry required to push the layer json, that made a lot of "duplicated layer"
-//So images manifests contain duplicated layers (layers with same content and then same tarsum), we can clean them up
-func cleanupManifest(manifest *registry.ManifestData) {
-	found := make(map[string]bool)
-	cleanFSLayers := []*registry.FSLayer{}
-	for _, layer := range manifest.FSLayers {
-		if !found[layer.BlobSum] {
-			found[layer.BlobSum] = true
-			cleanFSLayers = append(cleanFSLayers, &registry.FSLayer{BlobSum: layer.BlobSum})
+//digest of a manifest fetched by reference: the reference itself if it's a digest (already verified)
+func referenceDigest(rawManifest []byte, reference string) (string, error) {
+	if isDigest(reference) {
+		return reference, nil
+	}
+	return manifestDigest(rawManifest)
+}
+
+func (s *registrySession) v2EndpointAndAuth(imageName string) (*registry.Endpoint, *registry.RequestAuthorization, error) {
+	endpoint, err := s.V2RegistryEndpoint(s.indexInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, err := s.GetV2Authorization(endpoint, imageName, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	printf("Registry endpoint: %v\n", endpoint)
+	return endpoint, auth, nil
+}
+
+//fetch a manifest, making sure it matches reference if it's a digest and that its signatures comply with the
+//session signature policy. Return the manifest and its media type
+func (s *registrySession) getVerifiedV2Manifest(endpoint *registry.Endpoint, auth *registry.RequestAuthorization, imageName, reference string) ([]byte, string, error) {
+	rawManifest, contentType, err := s.getV2Manifest(endpoint, auth, imageName, reference)
+	if err != nil {
+		if errorStatusCode(err) == http.StatusNotFound && !isDigest(reference) {
+			//the repository exists if its tags can be listed: the tag is wrong
+			if tags, tagsErr := s.GetV2RemoteTags(endpoint, imageName, auth); tagsErr == nil {
+				return nil, "", tagNotFoundError(imageName, reference, tags)
+			}
+		}
+		return nil, "", err
+	}
+
+	if isDigest(reference) {
+		//pinned content, refuse to continue if the registry served something else
+		if err := verifyManifestDigest(rawManifest, reference); err != nil {
+			return nil, "", err
+		}
+		printf("Manifest digest verified: %v\n", reference)
+	}
+
+	mediaType := manifestMediaType(rawManifest, contentType)
+	if !isManifestList(mediaType) {
+		if err := s.sigPolicy.check(rawManifest, mediaType); err != nil {
+			return nil, "", err
 		}
 	}
-	manifest.FSLayers = cleanFSLayers
+	return rawManifest, mediaType, nil
 }
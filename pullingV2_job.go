@@ -1,59 +1,137 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"strings"
 
-	"github.com/docker/docker/pkg/tarsum"
 	"github.com/docker/docker/registry"
 )
 
 type PullingV2Job struct {
-	Session   *registrySession
-	Endpoint  *registry.Endpoint
-	Auth      *registry.RequestAuthorization
-	ImageName string
-	SumStr    string
+	Session      *registrySession
+	Endpoint     *registry.Endpoint
+	Auth         *registry.RequestAuthorization
+	ImageName    string
+	SumStr       string
+	ExpectedSize int64 //0 if unknown
 
 	LayerId string
 
-	LayerDataReader   io.ReadCloser
-	LayerTarSumReader tarsum.TarSum
-	LayerSize         int64
+	LayerDataReader io.ReadCloser
+	LayerSize       int64
+
+	Attempts int
+	CacheHit bool
+	Verified bool //false if verification was skipped
+
+	progress *transferProgress
 
 	Err error
 }
 
-func NewPullingV2Job(session *registrySession, endpoint *registry.Endpoint, auth *registry.RequestAuthorization, imageName, sumStr string) *PullingV2Job {
-	return &PullingV2Job{Session: session, Endpoint: endpoint, Auth: auth, ImageName: imageName, SumStr: sumStr}
+func NewPullingV2Job(session *registrySession, endpoint *registry.Endpoint, auth *registry.RequestAuthorization, imageName, sumStr string, expectedSize int64) *PullingV2Job {
+	return &PullingV2Job{Session: session, Endpoint: endpoint, Auth: auth, ImageName: imageName, SumStr: sumStr, ExpectedSize: expectedSize, progress: newTransferProgress(sumStr)}
 }
 
-func (job *PullingV2Job) Start() {
+func (job *PullingV2Job) Start(ctx context.Context) {
 	chunks := strings.SplitN(job.SumStr, ":", 2)
 	if len(chunks) < 2 {
 		job.Err = fmt.Errorf("expected 2 parts in the sumStr, got %#v", chunks)
 		return
 	}
-	sumType, checksum := chunks[0], chunks[1]
-	fmt.Printf("\t%s ...\n", checksum)
-	job.LayerDataReader, job.LayerSize, job.Err = job.Session.GetV2ImageBlobReader(job.Endpoint, job.ImageName, sumType, checksum, job.Auth)
+	checksum := chunks[1]
+
+	if cache := job.Session.cache; cache != nil {
+		job.fromCache(cache)
+	}
+	if job.CacheHit {
+		job.progress.skip(job.LayerSize, "cached")
+	} else {
+		ctx = withProgress(ctx, job.progress)
+		job.progress.setTotal(job.ExpectedSize)
+		job.Attempts, job.Err = job.Session.retryPolicy.do(ctx, checksum, func() error {
+			return job.pull(ctx)
+		})
+	}
 	if job.Err != nil {
+		if ctx.Err() == nil {
+			job.Err = wrapError(job.Err, "layer %v: %v (%d attempts)", checksum, job.Err, job.Attempts)
+		}
 		return
 	}
+	job.progress.finish()
+}
 
-	job.LayerTarSumReader, job.Err = tarsum.NewTarSumForLabel(job.LayerDataReader, true, sumType)
-	if job.Err != nil {
-		return
+//download and verify the blob. Layers are verified before being applied so a corrupted or tampered
+//layer never reaches the rootfs
+func (job *PullingV2Job) pull(ctx context.Context) error {
+	//content digests are verified by the download, tarsums need the whole tar
+	expectedDigest := job.SumStr
+	if job.Session.skipVerify {
+		expectedDigest = ""
+	}
+
+	//spool the blob so the connection is released while the layer waits for the ones below it to be applied.
+	//An interrupted download is resumed on retry
+	spooled, size, err := resumableDownload(ctx, job.SumStr, job.ExpectedSize, expectedDigest, func(ctx context.Context, offset int64) (io.ReadCloser, bool, error) {
+		return job.Session.getV2Blob(ctx, job.Endpoint, job.Auth, job.ImageName, job.SumStr, offset)
+	})
+	if err != nil {
+		return err
+	}
+	if !job.Session.skipVerify && strings.HasPrefix(job.SumStr, "tarsum") {
+		if err := verifyBlob(spooled, job.SumStr); err != nil {
+			spooled.Close()
+			return err
+		}
 	}
+	job.Verified = !job.Session.skipVerify
 
-	fmt.Printf("\tDone %s\n", checksum)
+	//only verified content goes to the cache
+	if cache := job.Session.cache; cache != nil && job.Verified {
+		if err := cache.put(job.SumStr, spooled.Name()); err != nil {
+			printf("\t%v: failed to cache layer: %v\n", job.SumStr, err)
+		}
+	}
+	job.LayerDataReader, job.LayerSize = spooled, size
+	return nil
+}
+
+//load the blob from the local cache. Cached blobs are verified again, corrupted ones are evicted
+func (job *PullingV2Job) fromCache(cache *blobCache) {
+	f, size, err := cache.get(job.SumStr)
+	if err != nil {
+		return
+	}
+	if !job.Session.skipVerify {
+		if err := verifyBlob(f, job.SumStr); err != nil {
+			f.Close()
+			printf("\t%v: cached layer corrupted (%v), downloading it again\n", job.SumStr, err)
+			cache.evict(job.SumStr)
+			return
+		}
+	}
+	job.LayerDataReader, job.LayerSize, job.CacheHit, job.Verified = f, size, true, !job.Session.skipVerify
 }
 
 func (job *PullingV2Job) Error() error {
 	return job.Err
 }
 
+func (job *PullingV2Job) Progress() *transferProgress {
+	return job.progress
+}
+
 func (job *PullingV2Job) ID() string {
 	return job.SumStr
 }
+
+//release the downloaded layer
+func (job *PullingV2Job) Close() error {
+	if job.Err != nil || job.LayerDataReader == nil {
+		return nil
+	}
+	return job.LayerDataReader.Close()
+}
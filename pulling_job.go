@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 
@@ -17,33 +18,128 @@ type PullingJob struct {
 	LayerInfo []byte
 	LayerSize int
 
+	Attempts int
+	CacheHit bool
+
+	progress *transferProgress
+
 	Err error
 }
 
 func NewPullingJob(session *registrySession, repoData *registry.RepositoryData, layerId string) *PullingJob {
-	return &PullingJob{Session: session, RepoData: repoData, LayerId: layerId}
+	return &PullingJob{Session: session, RepoData: repoData, LayerId: layerId, progress: newTransferProgress(layerId)}
 }
 
-func (job *PullingJob) Start() {
-	fmt.Printf("\t%v\n", job.LayerId)
+//try every endpoint in order, retrying transient failures on each of them
+func (job *PullingJob) Start(ctx context.Context) {
+	if job.fromCache() {
+		job.progress.skip(int64(job.LayerSize), "cached")
+		return
+	}
+	ctx = withProgress(ctx, job.progress)
 	endpoints := job.RepoData.Endpoints
+
+	for i, ep := range endpoints {
+		attempts, err := job.Session.retryPolicy.do(ctx, job.LayerId, func() error {
+			return job.pullFrom(ctx, ep)
+		})
+		job.Attempts += attempts
+		if err == nil {
+			job.Err = nil
+			job.progress.finish()
+			return
+		}
+		job.Err = err
+		if ctx.Err() != nil {
+			return
+		}
+		if i < len(endpoints)-1 {
+			printf("\t%v: endpoint %v failed (%v), trying %v\n", job.LayerId, ep, err, endpoints[i+1])
+		}
+	}
+	if job.Err == nil {
+		job.Err = fmt.Errorf("no endpoint to pull from")
+	}
+	job.Err = wrapError(job.Err, "layer %v: %v (%d attempts)", job.LayerId, job.Err, job.Attempts)
+}
+
+func (job *PullingJob) pullFrom(ctx context.Context, ep string) error {
 	tokens := job.RepoData.Tokens
+	layerInfo, layerSize, err := job.Session.GetRemoteImageJSON(job.LayerId, ep, tokens)
+	if err != nil {
+		return err
+	}
+
+	job.progress.setTotal(int64(layerSize))
 
-	for _, ep := range endpoints {
-		job.LayerInfo, job.LayerSize, job.Err = job.Session.GetRemoteImageJSON(job.LayerId, ep, tokens)
-		if job.Err != nil {
-			continue
+	//spool the layer so the connection is released while the layer waits for the ones below it to be applied.
+	//An interrupted download is resumed on retry
+	spooled, _, err := resumableDownload(ctx, job.LayerId, int64(layerSize), "", func(ctx context.Context, offset int64) (io.ReadCloser, bool, error) {
+		return job.Session.getV1Layer(ctx, job.LayerId, ep, tokens, int64(layerSize), offset)
+	})
+	if err != nil {
+		return err
+	}
+	if cache := job.Session.cache; cache != nil {
+		//V1 layers have no digest, the one of the downloaded content is recorded to verify the cached layer
+		dgst, err := fileDigest(spooled)
+		if err == nil {
+			err = cache.putV1Info(job.LayerId, layerInfo, dgst)
+		}
+		if err == nil {
+			err = cache.put(v1CacheKey(job.LayerId), spooled.Name())
+		}
+		if err != nil {
+			printf("\t%v: failed to cache layer: %v\n", job.LayerId, err)
 		}
-		job.LayerData, job.Err = job.Session.GetRemoteImageLayer(job.LayerId, ep, tokens, int64(job.LayerSize))
 	}
+	job.LayerInfo, job.LayerSize, job.LayerData = layerInfo, layerSize, spooled
+	return nil
+}
 
-	fmt.Printf("\tDone %v\n", job.LayerId)
+//load the layer from the local cache, return false if it isn't cached. Cached layers are verified against the
+//digest recorded when they were cached, corrupted ones are evicted
+func (job *PullingJob) fromCache() bool {
+	cache := job.Session.cache
+	if cache == nil {
+		return false
+	}
+	info, err := cache.getV1Info(job.LayerId)
+	if err != nil {
+		return false
+	}
+	f, size, err := cache.get(v1CacheKey(job.LayerId))
+	if err != nil {
+		return false
+	}
+	if !job.Session.skipVerify {
+		if err := verifyBlob(f, info.Digest); err != nil {
+			f.Close()
+			printf("\t%v: cached layer corrupted (%v), downloading it again\n", job.LayerId, err)
+			cache.evict(v1CacheKey(job.LayerId))
+			return false
+		}
+	}
+	job.LayerInfo, job.LayerSize, job.LayerData, job.CacheHit = info.JSON, int(size), f, true
+	return true
 }
 
 func (job *PullingJob) Error() error {
 	return job.Err
 }
 
+func (job *PullingJob) Progress() *transferProgress {
+	return job.progress
+}
+
 func (job *PullingJob) ID() string {
 	return job.LayerId
 }
+
+//release the downloaded layer
+func (job *PullingJob) Close() error {
+	if job.Err != nil || job.LayerData == nil {
+		return nil
+	}
+	return job.LayerData.Close()
+}
@@ -2,104 +2,160 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
-	"path"
+	"os"
 
 	"github.com/docker/docker/registry"
 )
 
+//a git-layer branch exported and ready to be pushed to the V1 registry
+type exportedLayer struct {
+	Branch    branch
+	ImageID   string
+	JSON      []byte
+	SpoolPath string
+}
+
+//krgo push image -r rootfs
+//push a git layered image to the V1 registry: missing layers are uploaded concurrently, the tag and the final
+//index are only written once every layer is in the registry
 func (s *registrySession) pushRepository(imageName, imageTag, rootfs string) error {
 	if !isGitRepo(rootfs) {
 		return fmt.Errorf("%v not a git repository", rootfs)
 	}
 	gitRepo, _ := newGitRepo(rootfs)
+	if err := checkCommitted(gitRepo); err != nil {
+		return err
+	}
+
+	//layers are exported by checking out their branch, leave the repository as it was whatever happens
+	currentBr, err := gitRepo.currentBranch()
+	if err != nil {
+		return err
+	}
+	defer gitRepo.checkout(currentBr)
 
 	branches, err := gitRepo.branch()
 	if err != nil {
 		return err
 	}
-	var imageIds []string = make([]string, len(branches))
+	layers := make([]*exportedLayer, len(branches))
 	for _, br := range branches {
-		imageIds[br.number()] = br.imageID()
+		layers[br.number()] = &exportedLayer{Branch: br, ImageID: br.imageID()}
 	}
+	defer func() {
+		for _, layer := range layers {
+			if layer != nil && layer.SpoolPath != "" {
+				os.Remove(layer.SpoolPath)
+			}
+		}
+	}()
 
-	fmt.Printf("Pushing %d layers:\n", len(imageIds))
+	//exports need git checkouts which can't run concurrently, they are done up front
+	printf("Exporting %d layers:\n", len(layers))
+	for i, layer := range layers {
+		if layer == nil {
+			return fmt.Errorf("missing git layer branch layer_%d", i)
+		}
+		printf("\t%v ... ", layer.ImageID)
+		if err := exportLayer(gitRepo, layer); err != nil {
+			return err
+		}
+		printf("done\n")
+	}
 
 	//Push image index
 	var imageIndex []*registry.ImgData
-	for _, id := range imageIds {
-		imageIndex = append(imageIndex, &registry.ImgData{ID: id, Tag: imageTag})
+	for _, layer := range layers {
+		imageIndex = append(imageIndex, &registry.ImgData{ID: layer.ImageID, Tag: imageTag})
 	}
 	repoData, err := s.PushImageJSONIndex(imageName, imageIndex, false, nil)
 	if err != nil {
 		return err
 	}
-
 	ep := repoData.Endpoints[0]
-	//make sure existing branches are pushed
-	for i, imageId := range imageIds {
-		fmt.Printf("\t%v ... ", imageId)
-		if err := s.LookupRemoteImage(imageId, ep, repoData.Tokens); err == nil {
-			fmt.Printf("done (already pushed)\n")
-		} else {
-			err = s.pushImageLayer(gitRepo, branches[i], imageId, ep, repoData.Tokens)
-			if err != nil {
-				if err == registry.ErrAlreadyExists {
-					fmt.Printf("done (already pushed)\n")
-				} else {
-					return err
-				}
-			} else {
-				fmt.Printf("done\n")
-			}
-		}
 
-		//push tag
-		if err := s.PushRegistryTag(imageName, imageId, imageTag, ep, repoData.Tokens); err != nil {
+	printf("Pushing %d layers:\n", len(layers))
+	queue := s.newQueue()
+	defer queue.Progress.stop()
+	var parent *PushingJob
+	for _, layer := range layers {
+		job := NewPushingJob(s, ep, repoData.Tokens, layer.ImageID, layer.JSON, layer.SpoolPath, parent)
+		queue.Enqueue(job)
+		parent = job
+	}
+	for _, layer := range layers {
+		j, err := queue.WaitJob(layer.ImageID)
+		if err != nil {
+			queue.Cancel()
+			queue.Wait()
 			return err
 		}
+		job := j.(*PushingJob)
+		if job.AlreadyPushed {
+			printf("\t%v ... done (already pushed)\n", layer.ImageID)
+		} else {
+			printf("\t%v ... done\n", layer.ImageID)
+		}
+		s.report.addLayer(&layerReport{ID: layer.ImageID, Size: job.Progress().Total(), AlreadyPushed: job.AlreadyPushed})
 	}
 
-	//Finalize push
+	//every layer is in the registry, tag the top one and finalize push
+	topImageID := layers[len(layers)-1].ImageID
+	s.report.ImageID = topImageID
+	if err := s.PushRegistryTag(imageName, topImageID, imageTag, ep, repoData.Tokens); err != nil {
+		return err
+	}
 	if _, err = s.PushImageJSONIndex(imageName, imageIndex, true, repoData.Endpoints); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *registrySession) pushImageLayer(gitRepo *gitRepo, br branch, imgID, ep string, token []string) error {
-	if _, err := gitRepo.checkout(br); err != nil {
+//layers are exported from git branches, uncommitted changes wouldn't be pushed
+func checkCommitted(gitRepo *gitRepo) error {
+	dirty, err := gitRepo.isDirty()
+	if err != nil {
 		return err
 	}
+	if dirty {
+		return withExitCode(EXIT_GIT_DIRTY, fmt.Errorf("%v has uncommitted changes, commit them with krgo commit first", gitRepo.Path))
+	}
+	return nil
+}
 
-	jsonRaw, err := ioutil.ReadFile(path.Join(gitRepo.Path, "json"))
+//read the layer json and export its content into a temporary file
+func exportLayer(gitRepo *gitRepo, layer *exportedLayer) (err error) {
+	jsonRaw, err := gitRepo.showFile(layer.Branch, "json")
 	if err != nil {
 		//if json is not found, this probably means that user pull the image using V2 registry
-		fmt.Printf("Hint: you can't push images pulled using the -v2 flag yet")
+		printf("Hint: images pulled using the -v2 flag must be pushed using the -v2 flag\n")
 		return err
 	}
+	layer.JSON = jsonRaw
 
-	imgData := &registry.ImgData{
-		ID: imgID,
-	}
-
-	// Send the json
-	if err := s.PushImageJSONRegistry(imgData, jsonRaw, ep, token); err != nil {
-		return err
+	layerData, err := gitRepo.exportChangeSet(layer.Branch)
+	if err == ErrNoChange {
+		//metadata only layer, pushed as an empty tar
+		layerData, err = emptyTar()
 	}
-
-	layerData, err := gitRepo.exportChangeSet(br)
 	if err != nil {
 		return err
 	}
-	defer layerData.Close()
+	//the layer branch stays checked out until the export is closed
+	defer func() {
+		if closeErr := layerData.Close(); err == nil {
+			err = closeErr
+		}
+	}()
 
-	checksum, checksumPayload, err := s.PushImageLayerRegistry(imgID, layerData, ep, token, jsonRaw)
+	f, err := ioutil.TempFile("", "krgo_layer_")
 	if err != nil {
 		return err
 	}
-	imgData.Checksum = checksum
-	imgData.ChecksumPayload = checksumPayload
-
-	return s.PushImageChecksumRegistry(imgData, ep, token)
+	defer f.Close()
+	layer.SpoolPath = f.Name()
+	_, err = io.Copy(f, layerData)
+	return err
 }
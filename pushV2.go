@@ -1,145 +1,236 @@
-// +build ignore
-
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 
-	"github.com/docker/docker/pkg/tarsum"
 	"github.com/docker/docker/registry"
 )
 
-/*
-  Unused code, prepare the ground for full registry v2 when it's production ready
-*/
-
-func generateManifest(gitRepo *gitRepo, imageName, imageTag string) (*registry.ManifestData, error) {
-	branches, err := gitRepo.branch()
-	if err != nil {
-		return nil, err
-	}
-	var imageChecksums []string = make([]string, len(branches))
-	for _, br := range branches {
-		checksum := br.imageID()
-		sumTypeBytes, err := gitRepo.branchDescription(br)
-		if err != nil {
-			return nil, err
-		}
-		imageChecksums[br.number()] = string(sumTypeBytes) + ":" + checksum
-	}
-
-	manifest := &registry.ManifestData{
-		Name:          imageName,
-		Architecture:  "amd64", //unclean but so far looks ok ...
-		Tag:           imageTag,
-		SchemaVersion: 1,
-		FSLayers:      make([]*registry.FSLayer, 0, 4),
-	}
-
-	for i, checksum := range imageChecksums {
-		if tarsum.VersionLabelForChecksum(checksum) != tarsum.Version1.String() {
-			//need to calculate the tarsum V1 for each layer ...
-			layerData, err := gitRepo.exportChangeSet(branches[i])
-			if err == ErrNoChange {
-				continue
-			}
-			if err != nil {
-				return nil, err
-			}
-			defer layerData.Close()
-
-			tarSum, err := tarsum.NewTarSum(layerData, true, tarsum.Version1)
-			if err != nil {
-				return nil, err
-			}
-			if _, err := io.Copy(ioutil.Discard, tarSum); err != nil {
-				return nil, err
-			}
+//a git-layer branch ready to be pushed as a blob
+type layerBlob struct {
+	Branch    branch //empty for OCI layout blobs
+	BlobSum   string //sha256:<checksum> of the exported layer, content digest for OCI layout blobs
+	V1Compat  string //v1 json of the layer, needed by schema1 manifests
+	SpoolPath string //exported layer content, set once exported
+}
 
-			checksum = tarSum.Sum(nil)
-		}
-		manifest.FSLayers = append(manifest.FSLayers, &registry.FSLayer{BlobSum: checksum})
+func (blob *layerBlob) String() string {
+	if blob.Branch != "" {
+		return blob.Branch.string()
 	}
-	return manifest, nil
+	return blob.BlobSum
 }
 
+//krgo push image -r rootfs -v2
+//push a git layered image to the V2 registry: upload missing blobs concurrently and put a signed manifest under imageTag
 func (s *registrySession) pushRepositoryV2(imageName, imageTag, rootfs string) error {
 	if !isGitRepo(rootfs) {
 		return fmt.Errorf("%v not a git repository", rootfs)
 	}
 	gitRepo, _ := newGitRepo(rootfs)
+	if err := checkCommitted(gitRepo); err != nil {
+		return err
+	}
 
 	endpoint, err := s.V2RegistryEndpoint(s.indexInfo)
 	if err != nil {
 		return err
 	}
-	auth, err := s.GetV2Authorization(endpoint, imageName, true)
+	auth, err := s.GetV2Authorization(endpoint, imageName, false)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Registry endpoint: %v\n", endpoint)
+	printf("Registry endpoint: %v\n", endpoint)
 
-	manifest, err := generateManifest(gitRepo, imageName, imageTag)
+	blobs, err := layerBlobs(gitRepo)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		for _, blob := range blobs {
+			if blob.SpoolPath != "" {
+				os.Remove(blob.SpoolPath)
+			}
+		}
+	}()
+
+	//layers are exported up front: exports need git checkouts which can't run concurrently
+	printf("Exporting %d layers:\n", len(blobs))
+	for _, blob := range blobs {
+		printf("\t%v ... ", blob.Branch)
+		//its sha256 is the blob digest (may differ from the one the layer was pulled with)
+		if err := spoolLayerBlob(gitRepo, blob); err != nil {
+			return err
+		}
+		printf("done\n")
+	}
 
-	manifestBytes, err := json.MarshalIndent(manifest, "", "   ")
+	printf("Pushing %d layers:\n", len(blobs))
+	queue := s.newQueue()
+	defer queue.Progress.stop()
+	for _, blob := range blobs {
+		//identical layers are pushed once
+		if queue.hasJob(blob.BlobSum) {
+			continue
+		}
+		queue.Enqueue(NewPushingV2Job(s, endpoint, auth, imageName, blob))
+	}
+	for _, blob := range blobs {
+		j, err := queue.WaitJob(blob.BlobSum)
+		if err != nil {
+			queue.Cancel()
+			queue.Wait()
+			return err
+		}
+		job := j.(*PushingV2Job)
+		if job.AlreadyPushed {
+			printf("\t%v ... done (already pushed)\n", blob.Branch)
+		} else {
+			printf("\t%v ... done\n", blob.Branch)
+		}
+		s.report.addLayer(&layerReport{ID: blob.Branch.imageID(), Digest: blob.BlobSum, Size: job.Progress().Total(), AlreadyPushed: job.AlreadyPushed})
+	}
+
+	//the manifest is only put once every layer is in the registry
+	manifest := generateManifest(imageName, imageTag, blobs)
+	signedManifest, err := signManifest(manifest)
 	if err != nil {
 		return err
 	}
+	printf("Pushing manifest %v:%v\n", imageName, imageTag)
+	if err := s.PutV2ImageManifest(endpoint, imageName, imageTag, bytes.NewReader(signedManifest), auth); err != nil {
+		return err
+	}
+	s.report.ImageID = blobs[len(blobs)-1].Branch.imageID()
+	s.report.Digest, err = manifestDigest(signedManifest)
+	return err
+}
 
+func (s *registrySession) headBlobV2(endpoint *registry.Endpoint, auth *registry.RequestAuthorization, imageName, blobSum string) (bool, error) {
+	sumParts := strings.SplitN(blobSum, ":", 2)
+	if len(sumParts) < 2 {
+		return false, fmt.Errorf("Invalid checksum: %s", blobSum)
+	}
+	return s.HeadV2ImageBlob(endpoint, imageName, sumParts[0], sumParts[1], auth)
+}
+
+//list git-layer branches as blobs, base layer first. Blob digests are known once exported
+func layerBlobs(gitRepo *gitRepo) ([]*layerBlob, error) {
 	branches, err := gitRepo.branch()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	orderedBranches := make([]branch, len(branches))
+	blobs := make([]*layerBlob, len(branches))
 	for _, br := range branches {
-		orderedBranches[br.number()] = br
+		blobs[br.number()] = &layerBlob{Branch: br}
 	}
 
-	for i := len(manifest.FSLayers) - 1; i >= 0; i-- {
-		sumStr := manifest.FSLayers[i].BlobSum
-		sumParts := strings.SplitN(sumStr, ":", 2)
-		if len(sumParts) < 2 {
-			return fmt.Errorf("Invalid checksum: %s", sumStr)
+	for i, blob := range blobs {
+		if blob == nil {
+			return nil, fmt.Errorf("missing git layer branch layer_%d", i)
 		}
-		manifestSum := sumParts[1]
-
-		// Call mount blob
-		exists, err := s.HeadV2ImageBlob(endpoint, imageName, sumParts[0], manifestSum, auth)
+		jsonRaw, err := gitRepo.showFile(blob.Branch, "json")
 		if err != nil {
-			return err
-		}
-
-		if !exists {
-			fmt.Println("Image doesn't exist")
-			layerData, err := gitRepo.exportChangeSet(orderedBranches[i])
-			if err != nil {
-				return err
+			//pulled from the V2 registry: no json, generate a minimal one
+			parent := ""
+			if i > 0 {
+				parent = blobs[i-1].Branch.imageID()
 			}
-			defer layerData.Close()
-			fmt.Println(endpoint)
-			err = s.PutV2ImageBlob(endpoint, imageName, sumParts[0], sumParts[1], layerData, auth)
-			if err != nil {
-				return err
+			if jsonRaw, err = json.Marshal(newV1Compat(blob.Branch.imageID(), parent)); err != nil {
+				return nil, err
 			}
-
-			//todo push manifest
-		} else {
-			fmt.Println("Image already exists")
 		}
+		blob.V1Compat = string(jsonRaw)
+	}
+	return blobs, nil
+}
 
-		// push the manifest
-		if err := s.PutV2ImageManifest(endpoint, imageName, imageTag, bytes.NewReader([]byte(manifestBytes)), auth); err != nil {
-			return err
+type v1Compat struct {
+	ID      string    `json:"id"`
+	Parent  string    `json:"parent,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func newV1Compat(id, parent string) *v1Compat {
+	return &v1Compat{ID: id, Parent: parent, Created: time.Now().UTC()}
+}
+
+//export the layer into a temporary file computing its sha256 on the fly. Registries address blobs by content
+//digest, tarsums aren't accepted anymore
+func spoolLayerBlob(gitRepo *gitRepo, blob *layerBlob) (err error) {
+	layerData, err := gitRepo.exportChangeSet(blob.Branch)
+	if err == ErrNoChange {
+		//metadata only layer, pushed as an empty tar
+		layerData, err = emptyTar()
+	}
+	if err != nil {
+		return err
+	}
+	//closing checks the previous branch out back
+	defer func() {
+		if closeErr := layerData.Close(); err == nil {
+			err = closeErr
 		}
+	}()
+
+	f, err := ioutil.TempFile("", "krgo_layer_")
+	if err != nil {
+		return err
 	}
+	defer f.Close()
+	blob.SpoolPath = f.Name()
 
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), layerData); err != nil {
+		return err
+	}
+	blob.BlobSum = "sha256:" + hex.EncodeToString(h.Sum(nil))
 	return nil
 }
+
+func emptyTar() (io.ReadCloser, error) {
+	buf := &bytes.Buffer{}
+	if err := tar.NewWriter(buf).Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+//architecture of the image json of the top layer, host architecture if it doesn't tell
+func imageArchitecture(blobs []*layerBlob) string {
+	var img struct {
+		Architecture string `json:"architecture"`
+	}
+	if len(blobs) > 0 && json.Unmarshal([]byte(blobs[len(blobs)-1].V1Compat), &img) == nil && img.Architecture != "" {
+		return img.Architecture
+	}
+	return hostPlatform().Architecture
+}
+
+//schema1 manifest of the blobs (base layer first). Manifest layers are ordered top layer first
+func generateManifest(imageName, imageTag string, blobs []*layerBlob) *registry.ManifestData {
+	manifest := &registry.ManifestData{
+		Name:          imageName,
+		Architecture:  imageArchitecture(blobs),
+		Tag:           imageTag,
+		SchemaVersion: 1,
+		FSLayers:      make([]*registry.FSLayer, 0, len(blobs)),
+		History:       make([]*registry.ManifestHistory, 0, len(blobs)),
+	}
+
+	for i := len(blobs) - 1; i >= 0; i-- {
+		manifest.FSLayers = append(manifest.FSLayers, &registry.FSLayer{BlobSum: blobs[i].BlobSum})
+		manifest.History = append(manifest.History, &registry.ManifestHistory{V1Compatibility: blobs[i].V1Compat})
+	}
+	return manifest
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+//content of the layers of newTestLayeredRepo
+var testLayers = []map[string]string{
+	{"a.txt": "layer 0", "keep.txt": "layer 0"},
+	{"a.txt": "layer 1"},
+	{"b.txt": "layer 2", ".wh.a.txt": ""},
+}
+
+func TestSpoolLayerBlob(t *testing.T) {
+	fmt.Printf("Testing layer blob export ... ")
+	repoPath := "/tmp/git_repo_blobs"
+	r := newTestLayeredRepo(repoPath, t)
+	defer os.RemoveAll(repoPath)
+
+	blobs, err := layerBlobs(r)
+	asserErrNil(err, t)
+	if len(blobs) != len(testLayers) {
+		t.Fatalf("expected %d blobs got %d", len(testLayers), len(blobs))
+	}
+	sums := map[string]bool{}
+	for i, blob := range blobs {
+		asserErrNil(spoolLayerBlob(r, blob), t)
+		defer os.Remove(blob.SpoolPath)
+		//blobs are pushed by sha256, registries don't take tarsums
+		data, err := ioutil.ReadFile(blob.SpoolPath)
+		asserErrNil(err, t)
+		if sum, _ := computeDigest("sha256", data); blob.BlobSum != sum || sums[blob.BlobSum] {
+			t.Fatalf("unexpected blob sum %v, expected %v", blob.BlobSum, sum)
+		}
+		sums[blob.BlobSum] = true
+		if !strings.Contains(blob.V1Compat, blob.Branch.imageID()) {
+			t.Fatalf("unexpected layer json %v", blob.V1Compat)
+		}
+
+		f, err := os.Open(blob.SpoolPath)
+		asserErrNil(err, t)
+		tarShouldContain(f, testLayers[i], nil, t)
+		f.Close()
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestSpoolLayerBlobManyLayers(t *testing.T) {
+	fmt.Printf("Testing layer blob export with more than 10 layers ... ")
+	repoPath := "/tmp/git_repo_blobs_many"
+	r := newTestManyLayersRepo(repoPath, 12, t)
+	defer os.RemoveAll(repoPath)
+
+	blobs, err := layerBlobs(r)
+	asserErrNil(err, t)
+	for i, blob := range blobs {
+		asserErrNil(spoolLayerBlob(r, blob), t)
+		defer os.Remove(blob.SpoolPath)
+		f, err := os.Open(blob.SpoolPath)
+		asserErrNil(err, t)
+		files, unexpected := manyLayersFiles(i, len(blobs))
+		tarShouldContain(f, files, unexpected, t)
+		f.Close()
+	}
+	fmt.Printf("OK\n")
+}
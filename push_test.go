@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestExportLayer(t *testing.T) {
+	fmt.Printf("Testing V1 layer export ... ")
+	repoPath := "/tmp/git_repo_v1_layers"
+	r := newTestLayeredRepo(repoPath, t)
+	defer os.RemoveAll(repoPath)
+	brs, err := r.branch()
+	asserErrNil(err, t)
+
+	//layers are exported up front, each from its own branch
+	for i, br := range brs {
+		layer := &exportedLayer{Branch: br, ImageID: br.imageID()}
+		asserErrNil(exportLayer(r, layer), t)
+		defer os.Remove(layer.SpoolPath)
+		compat := &v1Compat{}
+		asserErrNil(json.Unmarshal(layer.JSON, compat), t)
+		if compat.ID != layer.ImageID {
+			t.Fatalf("expected json of %v got %v", layer.ImageID, compat.ID)
+		}
+		f, err := os.Open(layer.SpoolPath)
+		asserErrNil(err, t)
+		tarShouldContain(f, testLayers[i], nil, t)
+		f.Close()
+	}
+	if current, _ := r.currentBranch(); current != brs[len(brs)-1] {
+		t.Fatalf("expected %v checked out got %v", brs[len(brs)-1], current)
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestExportLayerManyLayers(t *testing.T) {
+	fmt.Printf("Testing V1 layer export with more than 10 layers ... ")
+	repoPath := "/tmp/git_repo_v1_many_layers"
+	r := newTestManyLayersRepo(repoPath, 12, t)
+	defer os.RemoveAll(repoPath)
+
+	brs := layerBranches(r, t)
+	for i, br := range brs {
+		layer := &exportedLayer{Branch: br, ImageID: br.imageID()}
+		asserErrNil(exportLayer(r, layer), t)
+		defer os.Remove(layer.SpoolPath)
+		f, err := os.Open(layer.SpoolPath)
+		asserErrNil(err, t)
+		files, unexpected := manyLayersFiles(i, len(brs))
+		tarShouldContain(f, files, unexpected, t)
+		f.Close()
+	}
+	fmt.Printf("OK\n")
+}
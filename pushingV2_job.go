@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/registry"
+)
+
+//upload an exported layer blob (or an OCI layout blob) unless the registry already has it
+type PushingV2Job struct {
+	Session   *registrySession
+	Endpoint  *registry.Endpoint
+	Auth      *registry.RequestAuthorization
+	ImageName string
+	Blob      *layerBlob
+
+	AlreadyPushed bool
+	Attempts      int
+
+	progress *transferProgress
+
+	Err error
+}
+
+func NewPushingV2Job(session *registrySession, endpoint *registry.Endpoint, auth *registry.RequestAuthorization, imageName string, blob *layerBlob) *PushingV2Job {
+	return &PushingV2Job{Session: session, Endpoint: endpoint, Auth: auth, ImageName: imageName, Blob: blob, progress: newTransferProgress(blob.BlobSum)}
+}
+
+func (job *PushingV2Job) Start(ctx context.Context) {
+	if fi, err := os.Stat(job.Blob.SpoolPath); err == nil {
+		job.progress.setTotal(fi.Size())
+	}
+	ctx = withProgress(ctx, job.progress)
+	job.Attempts, job.Err = job.Session.retryPolicy.do(ctx, job.Blob.BlobSum, func() error {
+		return job.push(ctx)
+	})
+	switch {
+	case job.Err != nil && ctx.Err() == nil:
+		job.Err = wrapError(job.Err, "layer %v: %v (%d attempts)", job.Blob, job.Err, job.Attempts)
+	case job.AlreadyPushed:
+		job.progress.skip(job.progress.Total(), "already pushed")
+	case job.Err == nil:
+		job.progress.finish()
+	}
+}
+
+func (job *PushingV2Job) push(ctx context.Context) error {
+	exists, err := job.Session.headBlobV2(job.Endpoint, job.Auth, job.ImageName, job.Blob.BlobSum)
+	if err != nil {
+		return err
+	}
+	if exists {
+		job.AlreadyPushed = true
+		return nil
+	}
+
+	f, err := os.Open(job.Blob.SpoolPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	job.progress.set(0)
+	sumParts := strings.SplitN(job.Blob.BlobSum, ":", 2)
+	//throttled and aborted with the queue
+	return job.Session.PutV2ImageBlob(job.Endpoint, job.ImageName, sumParts[0], sumParts[1], &ctxReader{ctx, f}, job.Auth)
+}
+
+func (job *PushingV2Job) Error() error {
+	return job.Err
+}
+
+func (job *PushingV2Job) Progress() *transferProgress {
+	return job.progress
+}
+
+func (job *PushingV2Job) ID() string {
+	return job.Blob.BlobSum
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/docker/docker/registry"
+)
+
+//push an exported layer to the V1 registry unless it's already there. The registry refuses the json of a layer
+//whose parent json it doesn't know, so the json is only pushed once the parent one is, layers are then uploaded
+//concurrently
+type PushingJob struct {
+	Session  *registrySession
+	Endpoint string
+	Tokens   []string
+
+	ImageID   string
+	JSON      []byte
+	SpoolPath string //exported layer
+
+	ParentJSONPushed <-chan struct{} //nil for the base layer
+	JSONPushed       chan struct{}   //closed once the layer json is in the registry
+
+	AlreadyPushed bool
+	Attempts      int
+
+	progress *transferProgress
+
+	Err error
+}
+
+func NewPushingJob(session *registrySession, endpoint string, tokens []string, imageID string, jsonRaw []byte, spoolPath string, parent *PushingJob) *PushingJob {
+	job := &PushingJob{Session: session, Endpoint: endpoint, Tokens: tokens, ImageID: imageID, JSON: jsonRaw, SpoolPath: spoolPath, JSONPushed: make(chan struct{}), progress: newTransferProgress(imageID)}
+	if parent != nil {
+		job.ParentJSONPushed = parent.JSONPushed
+	}
+	return job
+}
+
+func (job *PushingJob) Start(ctx context.Context) {
+	if fi, err := os.Stat(job.SpoolPath); err == nil {
+		job.progress.setTotal(fi.Size())
+	}
+	defer func() {
+		if job.AlreadyPushed {
+			job.progress.skip(job.progress.Total(), "already pushed")
+		} else if job.Err == nil {
+			job.progress.finish()
+		}
+	}()
+	ctx = withProgress(ctx, job.progress)
+
+	if err := job.Session.LookupRemoteImage(job.ImageID, job.Endpoint, job.Tokens); err == nil {
+		job.AlreadyPushed = true
+		close(job.JSONPushed)
+		return
+	}
+
+	if job.ParentJSONPushed != nil {
+		select {
+		case <-job.ParentJSONPushed:
+		case <-ctx.Done():
+			job.Err = ctx.Err()
+			return
+		}
+	}
+
+	imgData := &registry.ImgData{ID: job.ImageID}
+	job.Attempts, job.Err = job.Session.retryPolicy.do(ctx, job.ImageID, func() error {
+		return job.Session.PushImageJSONRegistry(imgData, job.JSON, job.Endpoint, job.Tokens)
+	})
+	if job.Err == registry.ErrAlreadyExists {
+		job.AlreadyPushed, job.Err = true, nil
+		close(job.JSONPushed)
+		return
+	}
+	if job.Err != nil {
+		job.wrapErr(ctx)
+		return
+	}
+	close(job.JSONPushed)
+
+	attempts := 0
+	attempts, job.Err = job.Session.retryPolicy.do(ctx, job.ImageID, func() error {
+		return job.pushLayer(ctx, imgData)
+	})
+	job.Attempts += attempts
+	if job.Err == registry.ErrAlreadyExists {
+		job.AlreadyPushed, job.Err = true, nil
+	}
+	job.wrapErr(ctx)
+}
+
+func (job *PushingJob) pushLayer(ctx context.Context, imgData *registry.ImgData) error {
+	f, err := os.Open(job.SpoolPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	job.progress.set(0)
+
+	//throttled and aborted with the queue
+	checksum, checksumPayload, err := job.Session.PushImageLayerRegistry(job.ImageID, &ctxReader{ctx, f}, job.Endpoint, job.Tokens, job.JSON)
+	if err != nil {
+		return err
+	}
+	imgData.Checksum = checksum
+	imgData.ChecksumPayload = checksumPayload
+	return job.Session.PushImageChecksumRegistry(imgData, job.Endpoint, job.Tokens)
+}
+
+func (job *PushingJob) wrapErr(ctx context.Context) {
+	if job.Err != nil && ctx.Err() == nil {
+		job.Err = wrapError(job.Err, "layer %v: %v (%d attempts)", job.ImageID, job.Err, job.Attempts)
+	}
+}
+
+func (job *PushingJob) Error() error {
+	return job.Err
+}
+
+func (job *PushingJob) Progress() *transferProgress {
+	return job.progress
+}
+
+func (job *PushingJob) ID() string {
+	return job.ImageID
+}
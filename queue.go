@@ -1,36 +1,78 @@
 package main
 
 import (
-	"log"
+	"context"
+	"strings"
 	"sync"
 )
 
 type Job interface {
-	Start()
+	Start(ctx context.Context)
 	Error() error
 	ID() string
 }
 
+//errors of the jobs of a queue
+type QueueError []error
+
+func (errs QueueError) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+//Queue runs jobs with a concurrency limit. The first failing job cancels the others.
+//Transfers of the jobs are throttled by Limiter (if not nil), shared through the context jobs are started with
 type Queue struct {
 	Concurrency   int
+	Limiter       *rateLimiter
+	Progress      *progressDisplay //tracks jobs reporting their progress if not nil
 	NbRunningJob  int
 	WaitingJobs   []Job
 	Lock          *sync.Mutex
-	DoneChan      chan bool
-	PerJobChan    chan string
 	CompletedJobs map[string]Job
+
+	ctx          context.Context
+	cancel       context.CancelFunc
+	errs         QueueError
+	jobDoneChans map[string]chan bool
+	pendingJobs  sync.WaitGroup
 }
 
-func NewQueue(concurrency int) *Queue {
-	doneChan := make(chan bool)
-	perJobChan := make(chan string, 10000)
-	return &Queue{Concurrency: concurrency, Lock: &sync.Mutex{}, DoneChan: doneChan, PerJobChan: perJobChan, CompletedJobs: make(map[string]Job)}
+//jobs are canceled when ctx is. limiter may be nil
+func NewQueue(ctx context.Context, concurrency int, limiter *rateLimiter) *Queue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(withRateLimiter(ctx, limiter))
+	return &Queue{
+		Concurrency:   concurrency,
+		Limiter:       limiter,
+		Lock:          &sync.Mutex{},
+		CompletedJobs: make(map[string]Job),
+		ctx:           ctx,
+		cancel:        cancel,
+		jobDoneChans:  make(map[string]chan bool),
+	}
 }
 
 func (queue *Queue) Enqueue(job Job) {
 	queue.Lock.Lock()
 	defer queue.Lock.Unlock()
 
+	queue.jobDoneChans[job.ID()] = make(chan bool)
+	if queue.ctx.Err() != nil {
+		//canceled queue, the job will never run
+		close(queue.jobDoneChans[job.ID()])
+		return
+	}
+	queue.pendingJobs.Add(1)
+	if reporter, ok := job.(ProgressReporter); ok && queue.Progress != nil {
+		queue.Progress.track(reporter.Progress())
+	}
+
 	if !queue.canLaunchJob() {
 		//concurrency limit reached, make the job wait
 		queue.WaitingJobs = append(queue.WaitingJobs, job)
@@ -43,7 +85,7 @@ func (queue *Queue) startJob(job Job) {
 	queue.NbRunningJob++
 	go func() {
 		//start the job
-		job.Start()
+		job.Start(queue.ctx)
 		queue.dequeue(job)
 	}()
 }
@@ -52,26 +94,107 @@ func (queue *Queue) dequeue(job Job) {
 	queue.Lock.Lock()
 	defer queue.Lock.Unlock()
 
-	if job.Error() != nil {
-		log.Fatal(job.Error())
+	if err := job.Error(); err != nil {
+		//once the queue is canceled, siblings fail because of the cancellation (context.Canceled, possibly wrapped
+		//in transport errors): only errors happening before are worth reporting
+		if queue.ctx.Err() == nil {
+			queue.errs = append(queue.errs, err)
+		}
+		queue.cancelWaitingJobs()
 	}
 	queue.CompletedJobs[job.ID()] = job
-	queue.PerJobChan <- job.ID()
+	close(queue.jobDoneChans[job.ID()])
+	queue.pendingJobs.Done()
 
 	queue.NbRunningJob--
+	if queue.ctx.Err() != nil {
+		queue.cancelWaitingJobs()
+	}
 	if queue.canLaunchJob() && len(queue.WaitingJobs) > 0 {
 		queue.startJob(queue.WaitingJobs[0])
 		queue.WaitingJobs = append(queue.WaitingJobs[:0], queue.WaitingJobs[1:]...)
 	}
-	if len(queue.WaitingJobs) == 0 && queue.NbRunningJob == 0 {
-		queue.DoneChan <- true
+}
+
+//cancel running jobs and drop waiting ones, must be called with the lock held
+func (queue *Queue) cancelWaitingJobs() {
+	queue.cancel()
+	for _, job := range queue.WaitingJobs {
+		close(queue.jobDoneChans[job.ID()])
+		queue.pendingJobs.Done()
 	}
+	queue.WaitingJobs = nil
 }
 
 func (queue *Queue) canLaunchJob() bool {
 	return queue.NbRunningJob < queue.Concurrency
 }
 
+//cancel every job of the queue
+func (queue *Queue) Cancel() {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.cancelWaitingJobs()
+}
+
+//block until every job is completed or dropped, return the jobs errors if any
+func (queue *Queue) Wait() error {
+	queue.pendingJobs.Wait()
+	return queue.Err()
+}
+
+//jobs errors, the cancellation error if the queue was canceled without job failure
+func (queue *Queue) Err() error {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	if len(queue.errs) > 0 {
+		return queue.errs
+	}
+	return queue.ctx.Err()
+}
+
+//whether a job with jobId was enqueued
+func (queue *Queue) hasJob(jobId string) bool {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	_, ok := queue.jobDoneChans[jobId]
+	return ok
+}
+
 func (queue *Queue) CompletedJobWithID(jobId string) Job {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
 	return queue.CompletedJobs[jobId]
 }
+
+//block until the job jobId is completed and return it, other jobs keep running meanwhile.
+//An error is returned if the job failed or was dropped because the queue was canceled. When a job failure
+//canceled the queue, that failure is returned rather than the cancellation error of the job
+func (queue *Queue) WaitJob(jobId string) (Job, error) {
+	queue.Lock.Lock()
+	doneChan, ok := queue.jobDoneChans[jobId]
+	queue.Lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	<-doneChan
+
+	job := queue.CompletedJobWithID(jobId)
+	if job == nil {
+		return nil, queue.firstErr()
+	}
+	if job.Error() != nil {
+		return job, queue.firstErr()
+	}
+	return job, nil
+}
+
+//first job failure, the cancellation error if the queue was canceled without job failure
+func (queue *Queue) firstErr() error {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	if len(queue.errs) > 0 {
+		return queue.errs[0]
+	}
+	return queue.ctx.Err()
+}
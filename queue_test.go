@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type sleepingJob struct {
+	id       string
+	duration time.Duration
+	fail     error
+	wrap     bool //cancellation errors wrapped like HTTP clients do
+	done     bool
+	err      error
+}
+
+func (job *sleepingJob) Start(ctx context.Context) {
+	select {
+	case <-time.After(job.duration):
+		job.done = true
+		job.err = job.fail
+	case <-ctx.Done():
+		job.err = ctx.Err()
+		if job.wrap {
+			job.err = &url.Error{Op: "Get", URL: "https://registry/v2/", Err: job.err}
+		}
+	}
+}
+
+func (job *sleepingJob) Error() error {
+	return job.err
+}
+
+func (job *sleepingJob) ID() string {
+	return job.id
+}
+
+func TestQueueWaitJob(t *testing.T) {
+	fmt.Printf("Testing queue ... ")
+	queue := NewQueue(context.Background(), 2, nil)
+	//first jobs are the slowest ones, waiting for them must not prevent the others from completing
+	for i := 0; i < 5; i++ {
+		queue.Enqueue(&sleepingJob{id: strconv.Itoa(i), duration: time.Duration(5-i) * 10 * time.Millisecond})
+	}
+	for i := 0; i < 5; i++ {
+		j, err := queue.WaitJob(strconv.Itoa(i))
+		asserErrNil(err, t)
+		if job := j.(*sleepingJob); !job.done {
+			t.Fatalf("job %v returned before completion", job.id)
+		}
+	}
+	if j, _ := queue.WaitJob("unknown"); j != nil || queue.hasJob("unknown") {
+		t.Fatal("expected no job for an unknown id")
+	}
+	if !queue.hasJob("0") {
+		t.Fatal("expected job 0 to be known")
+	}
+	asserErrNil(queue.Wait(), t)
+	fmt.Printf("OK\n")
+}
+
+func TestQueueFailure(t *testing.T) {
+	fmt.Printf("Testing queue failure ... ")
+	failure := fmt.Errorf("layer download failed")
+	queue := NewQueue(context.Background(), 2, nil)
+	queue.Enqueue(&sleepingJob{id: "slow", duration: time.Hour, wrap: true})
+	queue.Enqueue(&sleepingJob{id: "failing", duration: 10 * time.Millisecond, fail: failure})
+	queue.Enqueue(&sleepingJob{id: "waiting", duration: time.Millisecond})
+
+	done := make(chan error)
+	go func() {
+		done <- queue.Wait()
+	}()
+	select {
+	case err := <-done:
+		errs, ok := err.(QueueError)
+		if !ok || len(errs) != 1 || errs[0] != failure {
+			t.Fatalf("expected %v got %v", failure, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failing job didn't cancel its siblings")
+	}
+
+	//the waiting job never ran, the slow one was canceled: both report the failure that canceled them
+	if _, err := queue.WaitJob("waiting"); err != failure {
+		t.Fatalf("expected %v for a job dropped by the cancellation got %v", failure, err)
+	}
+	if _, err := queue.WaitJob("slow"); err != failure {
+		t.Fatalf("expected %v got %v", failure, err)
+	}
+
+	//enqueuing on a canceled queue doesn't run anything
+	queue.Enqueue(&sleepingJob{id: "late", duration: time.Hour})
+	if _, err := queue.WaitJob("late"); err == nil {
+		t.Fatal("expected an error for a job enqueued after the cancellation")
+	}
+	fmt.Printf("OK\n")
+}
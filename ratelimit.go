@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//token bucket shared by every transfers of a queue so the overall bandwidth stays under rate
+type rateLimiter struct {
+	rate   float64 //bytes per second
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+//largest chunk worth transferring at once: a second of bandwidth, so a single read can't hog the limiter
+func (l *rateLimiter) burst() int {
+	if l.rate < 1 {
+		return 1
+	}
+	return int(l.rate)
+}
+
+//take n bytes from the bucket, block until the debt is paid back or ctx is canceled
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type rateLimiterKey struct{}
+
+//attach limiter to ctx, transfers made with ctx are throttled by it
+func withRateLimiter(ctx context.Context, limiter *rateLimiter) context.Context {
+	if limiter == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, rateLimiterKey{}, limiter)
+}
+
+//limiter attached to ctx, nil if transfers aren't throttled
+func rateLimiterFrom(ctx context.Context) *rateLimiter {
+	limiter, _ := ctx.Value(rateLimiterKey{}).(*rateLimiter)
+	return limiter
+}
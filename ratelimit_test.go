@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	fmt.Printf("Testing rate limiter ... ")
+	//100KB/s shared by 3 readers of 50KB: 150KB minus the initial 100KB burst take at least 500ms
+	limiter := newRateLimiter(100 * 1024)
+	queue := NewQueue(context.Background(), 3, limiter)
+	if rateLimiterFrom(queue.ctx) != limiter {
+		t.Fatal("expected the queue context to carry the limiter")
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(ioutil.Discard, &ctxReader{queue.ctx, bytes.NewReader(make([]byte, 50*1024))})
+			if err != nil || n != 50*1024 {
+				t.Errorf("expected 50KB read got %d (%v)", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("expected transfers to take about 500ms, took %v", elapsed)
+	}
+
+	//throttled transfers are aborted with the queue
+	queue.Cancel()
+	if err := limiter.wait(queue.ctx, 1024*1024); err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+
+	//no limiter, no throttling
+	if rateLimiterFrom(NewQueue(context.Background(), 1, nil).ctx) != nil {
+		t.Fatal("expected no limiter")
+	}
+	fmt.Printf("OK\n")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/registry"
+)
+
+const (
+	DEFAULT_TAG         = "latest"
+	MAX_NAME_LENGTH     = 255
+	OFFICIAL_REPO_SPACE = "library"
+)
+
+var (
+	ErrReferenceInvalidFormat = fmt.Errorf("invalid reference format")
+	ErrNameEmpty              = fmt.Errorf("repository name must have at least one component")
+	ErrNameTooLong            = fmt.Errorf("repository name must not be more than %d characters", MAX_NAME_LENGTH)
+	ErrNameNotCanonical       = fmt.Errorf("repository name must be lowercase")
+	ErrTagInvalidFormat       = fmt.Errorf("invalid tag format")
+	ErrDigestInvalidFormat    = fmt.Errorf("invalid digest format")
+
+	//grammar taken from docker distribution reference package
+	nameComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	domainRegexp        = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+	tagRegexp           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp        = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+)
+
+//imageReference is a parsed and normalized image reference:
+//[<registry_host>[:<port>]/]<repository_path>[:<tag>][@<digest>]
+type imageReference struct {
+	Registry string //registry host, registry.INDEXNAME for the docker hub
+	Name     string //repository path, official images are prefixed with library/ on the docker hub
+	Tag      string
+	Digest   string
+}
+
+//parse and normalize ref. defaultRegistry is used if ref doesn't specify a registry host, the docker hub is
+//used if it's empty as well. Tag defaults to latest unless a digest is given
+func parseImageReference(ref, defaultRegistry string) (*imageReference, error) {
+	if ref == "" {
+		return nil, ErrNameEmpty
+	}
+
+	r := &imageReference{}
+	remainder := ref
+
+	//digest
+	if i := strings.Index(remainder, "@"); i != -1 {
+		r.Digest = remainder[i+1:]
+		remainder = remainder[:i]
+		if !digestRegexp.MatchString(r.Digest) {
+			return nil, ErrDigestInvalidFormat
+		}
+	}
+
+	//tag, the last ":" after the last "/" (a ":" before is a registry port)
+	if i := strings.LastIndex(remainder, ":"); i != -1 && i > strings.LastIndex(remainder, "/") {
+		r.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if !tagRegexp.MatchString(r.Tag) {
+			return nil, ErrTagInvalidFormat
+		}
+	}
+
+	//registry host
+	if comps := strings.SplitN(remainder, "/", 2); len(comps) == 2 && isRegistryHost(comps[0]) {
+		if !domainRegexp.MatchString(comps[0]) {
+			return nil, fmt.Errorf("%v: invalid registry host %q", ErrReferenceInvalidFormat, comps[0])
+		}
+		r.Registry = comps[0]
+		remainder = comps[1]
+	} else {
+		r.Registry = defaultRegistry
+	}
+
+	if err := validateRepositoryName(remainder); err != nil {
+		return nil, err
+	}
+	r.Name = remainder
+
+	//normalization
+	if isDockerHub(r.Registry) {
+		r.Registry = registry.INDEXNAME
+		if !strings.Contains(r.Name, "/") {
+			r.Name = OFFICIAL_REPO_SPACE + "/" + r.Name
+		}
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = DEFAULT_TAG
+	}
+	return r, nil
+}
+
+//the first component of a reference is a registry host if it contains a "." or a ":" or is "localhost"
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+func validateRepositoryName(name string) error {
+	if name == "" {
+		return ErrNameEmpty
+	}
+	if len(name) > MAX_NAME_LENGTH {
+		return ErrNameTooLong
+	}
+	if strings.ToLower(name) != name {
+		return ErrNameNotCanonical
+	}
+	for _, comp := range strings.Split(name, "/") {
+		if !nameComponentRegexp.MatchString(comp) {
+			return fmt.Errorf("%v: invalid repository name component %q", ErrReferenceInvalidFormat, comp)
+		}
+	}
+	return nil
+}
+
+//return whether the reference points to the docker hub
+func (r *imageReference) isDockerHub() bool {
+	return r.Registry == registry.INDEXNAME
+}
+
+//return whether the reference is an official docker hub image
+func (r *imageReference) isOfficial() bool {
+	return r.isDockerHub() && strings.HasPrefix(r.Name, OFFICIAL_REPO_SPACE+"/")
+}
+
+//name as docker displays it: without the docker hub host nor the library/ prefix of official images
+func (r *imageReference) familiarName() string {
+	if r.isOfficial() {
+		return strings.TrimPrefix(r.Name, OFFICIAL_REPO_SPACE+"/")
+	}
+	if !r.isDockerHub() {
+		return r.Registry + "/" + r.Name
+	}
+	return r.Name
+}
+
+//what identifies the content in the repository: digest if present, tag otherwise
+func (r *imageReference) reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+//docker hub images are displayed without registry host, digest is displayed in place of the tag if present
+func (r *imageReference) String() string {
+	s := r.Name
+	if !r.isDockerHub() {
+		s = r.Registry + "/" + s
+	}
+	if r.Digest != "" {
+		return s + "@" + r.Digest
+	}
+	return s + ":" + r.Tag
+}
+
+//return whether registryHost designates the docker hub
+func isDockerHub(registryHost string) bool {
+	switch registryHost {
+	case "", registry.INDEXNAME, "index.docker.io", "registry-1.docker.io":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+const testDigest = "sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b"
+
+func TestParseImageReference(t *testing.T) {
+	fmt.Printf("Testing image reference parsing ... ")
+
+	validRefs := []struct {
+		ref, defaultRegistry string
+		expected             imageReference
+	}{
+		{"busybox", "", imageReference{"docker.io", "library/busybox", "latest", ""}},
+		{"busybox:1.0", "", imageReference{"docker.io", "library/busybox", "1.0", ""}},
+		{"progrium/busybox", "", imageReference{"docker.io", "progrium/busybox", "latest", ""}},
+		{"docker.io/busybox", "", imageReference{"docker.io", "library/busybox", "latest", ""}},
+		{"index.docker.io/robinmonjo/busybox:krgo", "", imageReference{"docker.io", "robinmonjo/busybox", "krgo", ""}},
+		{"localhost:5000/foo:bar", "", imageReference{"localhost:5000", "foo", "bar", ""}},
+		{"localhost/foo", "", imageReference{"localhost", "foo", "latest", ""}},
+		{"registry.local:5000/team/app:tag", "", imageReference{"registry.local:5000", "team/app", "tag", ""}},
+		{"team/app", "registry.local:5000", imageReference{"registry.local:5000", "team/app", "latest", ""}},
+		{"other.registry/app", "registry.local:5000", imageReference{"other.registry", "app", "latest", ""}},
+		{"busybox@" + testDigest, "", imageReference{"docker.io", "library/busybox", "", testDigest}},
+		{"localhost:5000/foo:bar@" + testDigest, "", imageReference{"localhost:5000", "foo", "bar", testDigest}},
+		{"a/b-c/d__e.f:v1.2-rc_3", "", imageReference{"docker.io", "a/b-c/d__e.f", "v1.2-rc_3", ""}},
+	}
+
+	for _, v := range validRefs {
+		ref, err := parseImageReference(v.ref, v.defaultRegistry)
+		if err != nil {
+			t.Fatalf("%v: unexpected error %v", v.ref, err)
+		}
+		if *ref != v.expected {
+			t.Fatalf("%v: got %#v expected %#v", v.ref, *ref, v.expected)
+		}
+	}
+
+	invalidRefs := []string{
+		"",
+		"Busybox",
+		"busybox:",
+		"busybox:-tag",
+		"busybox@sha256:123",
+		"busybox@" + testDigest[:20],
+		"foo//bar",
+		"-foo/bar",
+		"localhost:5000/",
+		"bad_host:5000:/foo",
+	}
+
+	for _, ref := range invalidRefs {
+		if _, err := parseImageReference(ref, ""); err == nil {
+			t.Fatalf("%v: expected an error", ref)
+		}
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestImageReferenceString(t *testing.T) {
+	refs := map[string]string{
+		"busybox":                               "library/busybox:latest",
+		"localhost:5000/foo:bar":                "localhost:5000/foo:bar",
+		"busybox:1.0@" + testDigest:             "library/busybox@" + testDigest,
+		"registry.local/team/app@" + testDigest: "registry.local/team/app@" + testDigest,
+	}
+	for ref, expected := range refs {
+		r, err := parseImageReference(ref, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.String() != expected {
+			t.Fatalf("%v: got %v expected %v", ref, r.String(), expected)
+		}
+	}
+}
+
+func TestImageReferenceFamiliarName(t *testing.T) {
+	refs := map[string]string{
+		"busybox":                "busybox",
+		"docker.io/team/app:1.0": "team/app",
+		"localhost:5000/foo:bar": "localhost:5000/foo",
+	}
+	for ref, expected := range refs {
+		r, err := parseImageReference(ref, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.familiarName() != expected {
+			t.Fatalf("%v: got %v expected %v", ref, r.familiarName(), expected)
+		}
+	}
+}
@@ -1,40 +1,93 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"net/http"
 
 	"github.com/docker/docker/registry"
 )
 
+const DEFAULT_CONCURRENCY = 7
+
 type registrySession struct {
 	registry.Session
-	indexInfo *registry.IndexInfo
+	indexInfo     *registry.IndexInfo
+	indexEndpoint *registry.Endpoint
+	client        *http.Client
+	retryPolicy   *retryPolicy
+	cache         *blobCache //nil if layers must not be cached
+	skipVerify    bool       //don't verify layers against their digest
+	sigPolicy     *signaturePolicy
+	concurrency   int          //layers transferred in parallel
+	rateLimiter   *rateLimiter //nil if bandwidth isn't limited
+	report        *transferReport
 }
 
-//return a registrySession associated with the repository contained in imageName
-func newRegistrySession(userName, password string) (*registrySession, error) {
-	//IndexInfo
-	indexInfo := &registry.IndexInfo{
-		Name:     registry.INDEXNAME,
-		Mirrors:  []string{},
-		Secure:   true,
-		Official: true,
-	}
+//return a registrySession associated with the registry registryHost (docker hub if empty).
+//insecure allows to fallback on plain HTTP and to skip TLS verification.
+//If no userName is given, credentials are resolved from docker config files and credential helpers
+func newRegistrySession(userName, password, registryHost string, insecure bool) (*registrySession, error) {
+	indexInfo := newIndexInfo(registryHost, insecure)
 
 	endpoint, err := registry.NewEndpoint(indexInfo)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Index endpoint: %s\n", endpoint)
+	printf("Index endpoint: %s\n", endpoint)
 
 	authConfig := &registry.AuthConfig{Username: userName, Password: password}
+	if userName == "" {
+		storedAuthConfig, err := resolveCredentials(indexInfo.Name)
+		if err == nil {
+			printf("Using stored credentials of %v\n", storedAuthConfig.Username)
+			authConfig = storedAuthConfig
+		} else if err != ErrCredentialsNotFound {
+			return nil, err
+		}
+	}
+	authConfig.ServerAddress = indexInfo.GetAuthConfigKey()
 
 	var metaHeaders map[string][]string
 
 	session, err := registry.NewSession(authConfig, registry.HTTPRequestFactory(metaHeaders), endpoint, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create registry session: %v", err)
+		return nil, wrapError(err, "failed to create registry session: %v", err)
+	}
+
+	return &registrySession{Session: *session, indexInfo: indexInfo, indexEndpoint: endpoint, client: newHTTPClient(insecure), retryPolicy: newRetryPolicy(DEFAULT_RETRIES), cache: newBlobCache(), sigPolicy: &signaturePolicy{}, concurrency: DEFAULT_CONCURRENCY, report: newTransferReport("", "")}, nil
+}
+
+//IndexInfo for the given registry host, the docker hub one if host is empty
+func newIndexInfo(registryHost string, insecure bool) *registry.IndexInfo {
+	if isDockerHub(registryHost) {
+		return &registry.IndexInfo{
+			Name:     registry.INDEXNAME,
+			Mirrors:  []string{},
+			Secure:   true,
+			Official: true,
+		}
+	}
+	return &registry.IndexInfo{
+		Name:     registryHost,
+		Mirrors:  []string{},
+		Secure:   !insecure,
+		Official: false,
 	}
+}
 
-	return &registrySession{*session, indexInfo}, nil
+//return whether the session talks to a registry that only speaks the V2 API
+func (s *registrySession) v2Only() bool {
+	return s.indexEndpoint.Version == registry.APIVersion2
+}
+
+//queue transferring layers with the session concurrency and bandwidth limits, displaying their progress.
+//The display must be stopped once transfers are over
+func (s *registrySession) newQueue() *Queue {
+	queue := NewQueue(context.Background(), s.concurrency, s.rateLimiter)
+	var events *jsonOutput
+	if jsonOut != nil && jsonOut.events {
+		events = jsonOut
+	}
+	queue.Progress = startProgressDisplay(stdout, events)
+	return queue
 }
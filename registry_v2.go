@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/registry"
+)
+
+const HTTP_TIMEOUT = 30 * time.Second
+
+//http client used for V2 requests the docker registry package doesn't cover (content negotiation, ranges ...)
+func newHTTPClient(insecure bool) *http.Client {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: HTTP_TIMEOUT,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: insecure},
+	}
+	return &http.Client{Transport: transport}
+}
+
+//url of a V2 API resource: /v2/<name>/<kind>/<reference>
+func v2URL(endpoint *registry.Endpoint, imageName, kind, reference string) string {
+	return fmt.Sprintf("%s/v2/%s/%s/%s", strings.TrimRight(endpoint.URL.String(), "/"), imageName, kind, reference)
+}
+
+//authorized V2 request
+func (s *registrySession) v2Request(ctx context.Context, method, url string, body io.Reader, auth *registry.RequestAuthorization, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if err := auth.Authorize(req); err != nil {
+		return nil, err
+	}
+	return s.client.Do(req)
+}
+
+//fetch a manifest by tag or digest, negotiating every format krgo supports. Return the raw manifest and its media type
+func (s *registrySession) getV2Manifest(endpoint *registry.Endpoint, auth *registry.RequestAuthorization, imageName, reference string) ([]byte, string, error) {
+	headers := map[string]string{"Accept": strings.Join(supportedManifestMediaTypes, ", ")}
+	res, err := s.v2Request(context.Background(), "GET", v2URL(endpoint, imageName, "manifests", reference), nil, auth, headers)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, "", newHTTPStatusError(res, fmt.Sprintf("error fetching manifest of %v:%v", imageName, reference))
+	}
+	rawManifest, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return rawManifest, res.Header.Get("Content-Type"), nil
+}
+
+//put a manifest of any format under reference (tag or digest). The docker registry package only puts schema1 manifests
+func (s *registrySession) putV2Manifest(endpoint *registry.Endpoint, auth *registry.RequestAuthorization, imageName, reference, mediaType string, rawManifest []byte) error {
+	headers := map[string]string{"Content-Type": mediaType}
+	res, err := s.v2Request(context.Background(), "PUT", v2URL(endpoint, imageName, "manifests", reference), bytes.NewReader(rawManifest), auth, headers)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return newHTTPStatusError(res, fmt.Sprintf("error putting manifest %v:%v", imageName, reference))
+	}
+	return nil
+}
+
+//fetch a blob by digest from offset, return its content and whether the range was honored.
+//The request is aborted if ctx is canceled
+func (s *registrySession) getV2Blob(ctx context.Context, endpoint *registry.Endpoint, auth *registry.RequestAuthorization, imageName, digest string, offset int64) (io.ReadCloser, bool, error) {
+	var headers map[string]string
+	if offset > 0 {
+		headers = map[string]string{"Range": rangeHeader(offset)}
+	}
+	res, err := s.v2Request(ctx, "GET", v2URL(endpoint, imageName, "blobs", digest), nil, auth, headers)
+	if err != nil {
+		return nil, false, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, false, newHTTPStatusError(res, fmt.Sprintf("error fetching blob %v of %v", digest, imageName))
+	}
+	return res.Body, isPartialResponse(res), nil
+}
+
+//fetch the image config blob and make sure it matches its digest
+func (s *registrySession) getV2ConfigBlob(endpoint *registry.Endpoint, auth *registry.RequestAuthorization, imageName, digest string) ([]byte, error) {
+	blob, _, err := s.getV2Blob(context.Background(), endpoint, auth, imageName, digest, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	rawConfig, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, err
+	}
+	//same check as layers: hex digests are case insensitive
+	if err := verifyBlob(bytes.NewReader(rawConfig), digest); err != nil {
+		return nil, wrapError(err, "image config: %v", err)
+	}
+	return rawConfig, nil
+}
+
+//fetch a V1 layer from offset. The docker registry package doesn't do range requests, so partial downloads are
+//resumed with a token authenticated request, falling back on a full download if it fails
+func (s *registrySession) getV1Layer(ctx context.Context, imgID, ep string, tokens []string, imgSize, offset int64) (io.ReadCloser, bool, error) {
+	if offset > 0 {
+		req, err := http.NewRequest("GET", ep+"images/"+imgID+"/layer", nil)
+		if err != nil {
+			return nil, false, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Range", rangeHeader(offset))
+		if len(tokens) > 0 {
+			req.Header.Set("Authorization", "Token "+strings.Join(tokens, ","))
+		}
+		res, err := s.client.Do(req)
+		if err == nil && isPartialResponse(res) {
+			return res.Body, true, nil
+		}
+		if err == nil {
+			res.Body.Close()
+		}
+	}
+	layerData, err := s.GetRemoteImageLayer(imgID, ep, tokens, imgSize)
+	return layerData, false, err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	OUTPUT_TEXT = "text"
+	OUTPUT_JSON = "json"
+)
+
+//result of a pull or a push, emitted with --output json
+type transferReport struct {
+	Image     string            `json:"image"`
+	ImageID   string            `json:"image_id,omitempty"`
+	Digest    string            `json:"digest,omitempty"` //manifest digest, V2 registry only
+	Rootfs    string            `json:"rootfs,omitempty"`
+	Layout    string            `json:"oci_layout,omitempty"`
+	Platform  string            `json:"platform,omitempty"`
+	Layers    []*layerReport    `json:"layers,omitempty"` //base layer first
+	Size      int64             `json:"size"`
+	Duration  float64           `json:"duration_seconds"`
+	Platforms []*transferReport `json:"platforms,omitempty"` //pulls of every platforms of an image
+
+	start time.Time
+}
+
+type layerReport struct {
+	ID            string `json:"id"`
+	Digest        string `json:"digest,omitempty"`
+	Size          int64  `json:"size"`
+	Cached        bool   `json:"cached,omitempty"`
+	AlreadyPushed bool   `json:"already_pushed,omitempty"`
+}
+
+//result of a commit, emitted with --output json
+type commitReport struct {
+	Branch  string `json:"branch"`
+	ImageID string `json:"image_id"`
+	Parent  string `json:"parent"`
+	Size    int64  `json:"size"`
+}
+
+type errorReport struct {
+	Error    string `json:"error"`
+	Kind     string `json:"kind"` //auth, not_found, rate_limited, verification, git_dirty, network or failure
+	ExitCode int    `json:"exit_code"`
+}
+
+//transfer progress, emitted as it happens with --progress-events
+type progressEvent struct {
+	Event   string    `json:"event"` //progress or done
+	ID      string    `json:"id"`
+	Current int64     `json:"current"`
+	Total   int64     `json:"total,omitempty"`
+	Note    string    `json:"note,omitempty"` //why nothing was transferred
+	Time    time.Time `json:"time"`
+}
+
+func newTransferReport(image, rootfs string) *transferReport {
+	return &transferReport{Image: image, Rootfs: rootfs, start: time.Now()}
+}
+
+func (r *transferReport) addLayer(layer *layerReport) {
+	r.Layers = append(r.Layers, layer)
+	r.Size += layer.Size
+}
+
+func (r *transferReport) finish() {
+	r.Duration = time.Since(r.start).Seconds()
+}
+
+//machine readable output: one json object per line
+type jsonOutput struct {
+	lock   sync.Mutex
+	enc    *json.Encoder
+	events bool //emit progress events
+}
+
+//set with --output json, nil otherwise
+var jsonOut *jsonOutput
+
+func newJSONOutput(w io.Writer, events bool) *jsonOutput {
+	return &jsonOutput{enc: json.NewEncoder(w), events: events}
+}
+
+func (o *jsonOutput) emit(v interface{}) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.enc.Encode(v)
+}
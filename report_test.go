@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestTransferReport(t *testing.T) {
+	fmt.Printf("Testing transfer report ... ")
+	report := newTransferReport("busybox:latest", "rootfs")
+	report.addLayer(&layerReport{ID: "base", Digest: "sha256:0123", Size: 2 * ONE_MB})
+	report.addLayer(&layerReport{ID: "top", Size: ONE_MB, Cached: true})
+	report.finish()
+
+	buf := &bytes.Buffer{}
+	asserErrNil(newJSONOutput(buf, false).emit(report), t)
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Fatalf("expected a single json line got %q", buf.String())
+	}
+	var decoded map[string]interface{}
+	asserErrNil(json.Unmarshal(buf.Bytes(), &decoded), t)
+	if decoded["image"] != "busybox:latest" || decoded["size"] != float64(3*ONE_MB) || len(decoded["layers"].([]interface{})) != 2 {
+		t.Fatalf("unexpected report %v", buf.String())
+	}
+	if _, ok := decoded["duration_seconds"]; !ok {
+		t.Fatalf("expected a duration got %v", buf.String())
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestProgressEvents(t *testing.T) {
+	fmt.Printf("Testing progress events ... ")
+	buf := &bytes.Buffer{}
+	d := startProgressDisplay(&console{w: ioutil.Discard}, newJSONOutput(buf, true))
+	p := newTransferProgress("layer")
+	p.setTotal(ONE_MB)
+	d.track(p)
+	p.set(ONE_MB / 2)
+	d.refresh(false)
+	d.refresh(false) //nothing changed, no event
+	cached := newTransferProgress("cached")
+	d.track(cached)
+	cached.skip(ONE_MB, "cached")
+	p.set(ONE_MB)
+	p.finish()
+	d.stop()
+
+	var events []progressEvent
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e progressEvent
+		asserErrNil(json.Unmarshal([]byte(line), &e), t)
+		events = append(events, e)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events got %q", buf.String())
+	}
+	if e := events[0]; e.Event != "progress" || e.ID != "layer" || e.Current != ONE_MB/2 || e.Total != ONE_MB {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if e := events[1]; e.Event != "done" || e.ID != "layer" || e.Current != ONE_MB {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if e := events[2]; e.Event != "done" || e.ID != "cached" || e.Note != "cached" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	fmt.Printf("OK\n")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/registry"
+)
+
+const (
+	DEFAULT_RETRIES     = 3
+	DEFAULT_RETRY_DELAY = 500 * time.Millisecond
+	MAX_RETRY_DELAY     = 30 * time.Second
+)
+
+//how failing requests are retried: exponential backoff with jitter, up to MaxRetries times
+type retryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+func newRetryPolicy(maxRetries int) *retryPolicy {
+	return &retryPolicy{MaxRetries: maxRetries, BaseDelay: DEFAULT_RETRY_DELAY, MaxDelay: MAX_RETRY_DELAY}
+}
+
+//registry answered with an unexpected status
+type httpStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration //delay asked by the registry (429 and 503)
+	Message    string
+}
+
+func newHTTPStatusError(res *http.Response, message string) *httpStatusError {
+	return &httpStatusError{StatusCode: res.StatusCode, RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")), Message: message}
+}
+
+func (err *httpStatusError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d)", err.Message, err.StatusCode)
+}
+
+//Retry-After format: delay in seconds or HTTP date
+func parseRetryAfter(retryAfter string) time.Duration {
+	if retryAfter == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		if d := date.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+//status code of registry errors, 0 if err doesn't come from an HTTP response
+func errorStatusCode(err error) int {
+	switch e := err.(type) {
+	case *krgoError:
+		if e.Cause != nil {
+			return errorStatusCode(e.Cause)
+		}
+		return errorStatusCode(e.Err)
+	case *httpStatusError:
+		return e.StatusCode
+	case *jsonmessage.JSONError:
+		return e.Code
+	}
+	return 0
+}
+
+//throttling, server errors and network errors are worth retrying, client errors are not
+func isRetryable(err error) bool {
+	if err == context.Canceled || err == context.DeadlineExceeded || err == registry.ErrAlreadyExists {
+		return false
+	}
+	code := errorStatusCode(err)
+	switch {
+	case code == 0:
+		return true
+	case code == http.StatusTooManyRequests || code == http.StatusRequestTimeout:
+		return true
+	case code >= 500:
+		return code != http.StatusNotImplemented
+	}
+	return false
+}
+
+//delay before retry number attempt (starting at 0): base * 2^attempt capped at MaxDelay, with jitter
+//in [delay/2, delay[ so concurrent jobs don't retry all at once
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+//run fn until it succeeds, fails with a non retryable error or MaxRetries retries are done. what names the
+//operation in retry messages. Return the last error and the number of attempts
+func (p *retryPolicy) do(ctx context.Context, what string, fn func() error) (int, error) {
+	attempt := 0
+	for {
+		err := fn()
+		attempt++
+		if err == nil || attempt > p.MaxRetries || !isRetryable(err) || ctx.Err() != nil {
+			return attempt, err
+		}
+
+		delay := p.backoff(attempt - 1)
+		if e, ok := err.(*httpStatusError); ok && e.RetryAfter > 0 {
+			delay = e.RetryAfter
+		}
+		printf("\t%v: attempt %d failed (%v), retrying in %v\n", what, attempt, err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		}
+	}
+}
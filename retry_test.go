@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	fmt.Printf("Testing retry policy ... ")
+	p := &retryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond}
+
+	for attempt, max := range []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond} {
+		if d := p.backoff(attempt); d < max/2 || d >= max {
+			t.Fatalf("attempt %d: backoff %v not in [%v, %v[", attempt, d, max/2, max)
+		}
+	}
+
+	//transient errors are retried MaxRetries times
+	calls := 0
+	attempts, err := p.do(context.Background(), "test", func() error {
+		calls++
+		return &httpStatusError{StatusCode: http.StatusServiceUnavailable, Message: "unavailable"}
+	})
+	if err == nil || attempts != 4 || calls != 4 {
+		t.Fatalf("expected 4 failed attempts got %d (%v)", attempts, err)
+	}
+
+	//succeeds after a transient error
+	calls = 0
+	attempts, err = p.do(context.Background(), "test", func() error {
+		calls++
+		if calls == 1 {
+			return &jsonmessage.JSONError{Code: http.StatusBadGateway, Message: "bad gateway"}
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("expected success after 2 attempts got %d (%v)", attempts, err)
+	}
+
+	//client errors are not retried
+	attempts, err = p.do(context.Background(), "test", func() error {
+		return &httpStatusError{StatusCode: http.StatusNotFound, Message: "not found"}
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("expected a single attempt got %d (%v)", attempts, err)
+	}
+
+	//Retry-After is honored
+	p.MaxRetries = 1
+	start := time.Now()
+	p.do(context.Background(), "test", func() error {
+		return &httpStatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 50 * time.Millisecond, Message: "slow down"}
+	})
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("Retry-After wasn't honored")
+	}
+	fmt.Printf("OK\n")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("120"); d != 120*time.Second {
+		t.Fatalf("expected 2m got %v", d)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("expected about 1h got %v", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Fatalf("expected 0 got %v", d)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+//layer content downloaded into a file, the file is removed once closed
+type spooledFile struct {
+	*os.File
+	closeOnce sync.Once
+	closeErr  error
+}
+
+//closing again does nothing: the partial file path may already be locked by another download
+func (f *spooledFile) Close() error {
+	f.closeOnce.Do(func() {
+		//removed before closing, so a download waiting for the lock on a partial file sees it is gone
+		os.Remove(f.Name())
+		f.closeErr = f.File.Close()
+	})
+	return f.closeErr
+}
+
+//reader failing with the context error once the context is canceled, throttled by the context rate limiter and
+//accounted to the context progress if any
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	limiter := rateLimiterFrom(cr.ctx)
+	if limiter != nil && len(p) > limiter.burst() {
+		p = p[:limiter.burst()]
+	}
+	n, err := cr.r.Read(p)
+	if progress := progressFrom(cr.ctx); progress != nil {
+		progress.add(int64(n))
+	}
+	if limiter != nil {
+		if werr := limiter.wait(cr.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
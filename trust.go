@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/docker/docker/registry"
+	"github.com/docker/libtrust"
+)
+
+const (
+	TRUST_KEY_FILE    = "key.json"
+	TRUSTED_KEYS_FILE = "trusted_keys.json" //public keys (JWK set or PEM) of trusted manifest signers
+
+	SIGNATURE_POLICY_PERMISSIVE = "permissive" //verify signatures when present, warn about unsigned and unknown keys
+	SIGNATURE_POLICY_STRICT     = "strict"     //reject unsigned manifests and manifests signed by unknown keys
+)
+
+var (
+	ErrManifestUnsigned = withExitCode(EXIT_VERIFICATION, fmt.Errorf("manifest is not signed"))
+	ErrUntrustedKey     = withExitCode(EXIT_VERIFICATION, fmt.Errorf("manifest is not signed by a trusted key"))
+	ErrSchema1Required  = withExitCode(EXIT_VERIFICATION, fmt.Errorf("strict signature policy requires schema1 manifests, only they can be signed"))
+)
+
+//what to do with manifest signatures
+type signaturePolicy struct {
+	Strict      bool
+	TrustedKeys map[string]libtrust.PublicKey //by key ID
+}
+
+//load krgo private key used to sign manifests, generate it on first use
+func loadOrCreateTrustKey() (libtrust.PrivateKey, error) {
+	keyPath := path.Join(krgoHome(), TRUST_KEY_FILE)
+	key, err := libtrust.LoadKeyFile(keyPath)
+	if err == nil {
+		return key, nil
+	}
+	if err != libtrust.ErrKeyFileDoesNotExist {
+		return nil, err
+	}
+
+	if key, err = libtrust.GenerateECP256PrivateKey(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(krgoHome(), 0700); err != nil {
+		return nil, err
+	}
+	if err := libtrust.SaveKey(keyPath, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//JWS sign the manifest (schema1) with krgo private key
+func signManifest(manifest *registry.ManifestData) ([]byte, error) {
+	manifestBytes, err := json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateTrustKey()
+	if err != nil {
+		return nil, err
+	}
+	js, err := libtrust.NewJSONSignature(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := js.Sign(key); err != nil {
+		return nil, err
+	}
+	return js.PrettySignature("signatures")
+}
+
+//build the signature policy of mode. Trusted keys are loaded from trustedKeysFile, or from ~/.krgo/trusted_keys.json
+//if it exists
+func newSignaturePolicy(mode, trustedKeysFile string) (*signaturePolicy, error) {
+	policy := &signaturePolicy{TrustedKeys: map[string]libtrust.PublicKey{}}
+	switch mode {
+	case SIGNATURE_POLICY_PERMISSIVE, "":
+	case SIGNATURE_POLICY_STRICT:
+		policy.Strict = true
+	default:
+		return nil, fmt.Errorf("unknown signature policy %q (expected %v or %v)", mode, SIGNATURE_POLICY_PERMISSIVE, SIGNATURE_POLICY_STRICT)
+	}
+
+	if trustedKeysFile == "" {
+		if defaultFile := path.Join(krgoHome(), TRUSTED_KEYS_FILE); fileExists(defaultFile) {
+			trustedKeysFile = defaultFile
+		}
+	}
+	if trustedKeysFile != "" {
+		if !fileExists(trustedKeysFile) {
+			return nil, fmt.Errorf("trusted keys file %v not found", trustedKeysFile)
+		}
+		keys, err := libtrust.LoadKeySetFile(trustedKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load trusted keys from %v: %v", trustedKeysFile, err)
+		}
+		for _, key := range keys {
+			policy.TrustedKeys[key.KeyID()] = key
+		}
+	}
+	if policy.Strict && len(policy.TrustedKeys) == 0 {
+		return nil, fmt.Errorf("%v signature policy requires trusted keys", SIGNATURE_POLICY_STRICT)
+	}
+	return policy, nil
+}
+
+//verify the JWS signatures of a schema1 manifest and return the signing keys. Unsigned manifests (including
+//schema2 and OCI ones, which have no signature) return no key and no error
+func manifestSigningKeys(rawManifest []byte) ([]libtrust.PublicKey, error) {
+	var signed struct {
+		Signatures []json.RawMessage `json:"signatures"`
+	}
+	if err := json.Unmarshal(rawManifest, &signed); err != nil {
+		return nil, err
+	}
+	if len(signed.Signatures) == 0 {
+		return nil, nil
+	}
+	js, err := libtrust.ParsePrettySignature(rawManifest, "signatures")
+	if err != nil {
+		return nil, err
+	}
+	return js.Verify()
+}
+
+//check the manifest signatures against the policy. Invalid signatures are always rejected. Only schema1
+//manifests carry signatures, other ones are rejected by the strict policy and not checked by the permissive one
+func (p *signaturePolicy) check(rawManifest []byte, mediaType string) error {
+	if mediaType != MEDIATYPE_DOCKER_SCHEMA1 && mediaType != MEDIATYPE_DOCKER_SCHEMA1_SIGNED {
+		if p.Strict {
+			return ErrSchema1Required
+		}
+		return nil
+	}
+	keys, err := manifestSigningKeys(rawManifest)
+	if err != nil {
+		return withExitCode(EXIT_VERIFICATION, fmt.Errorf("invalid manifest signature: %v", err))
+	}
+	if len(keys) == 0 {
+		if p.Strict {
+			return ErrManifestUnsigned
+		}
+		printf("WARNING: manifest is not signed\n")
+		return nil
+	}
+
+	trusted := false
+	for _, key := range keys {
+		if _, ok := p.TrustedKeys[key.KeyID()]; ok {
+			trusted = true
+			printf("Manifest signed by trusted key %v\n", key.KeyID())
+		} else {
+			printf("Manifest signed by unknown key %v\n", key.KeyID())
+		}
+	}
+	if !trusted {
+		if p.Strict {
+			return ErrUntrustedKey
+		}
+		if len(p.TrustedKeys) > 0 {
+			printf("WARNING: %v\n", ErrUntrustedKey)
+		}
+	}
+	return nil
+}
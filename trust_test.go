@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSignaturePolicy(t *testing.T) {
+	fmt.Printf("Testing manifest signature policy ... ")
+	os.Setenv(KRGO_HOME_ENV, "/tmp/krgo_trust")
+	defer os.Unsetenv(KRGO_HOME_ENV)
+
+	if _, err := newSignaturePolicy("paranoid", ""); err == nil {
+		t.Fatal("expected an unknown policy error")
+	}
+	if _, err := newSignaturePolicy(SIGNATURE_POLICY_STRICT, ""); err == nil {
+		t.Fatal("expected strict policy without trusted keys to be rejected")
+	}
+	if _, err := newSignaturePolicy(SIGNATURE_POLICY_PERMISSIVE, "/tmp/krgo_trust/missing.json"); err == nil {
+		t.Fatal("expected a missing trusted keys file error")
+	}
+
+	permissive, err := newSignaturePolicy(SIGNATURE_POLICY_PERMISSIVE, "")
+	asserErrNil(err, t)
+	unsigned := []byte(`{"schemaVersion": 1, "name": "foo", "tag": "latest", "fsLayers": [], "history": []}`)
+	asserErrNil(permissive.check(unsigned, MEDIATYPE_DOCKER_SCHEMA1), t)
+
+	strict := &signaturePolicy{Strict: true}
+	if err := strict.check(unsigned, MEDIATYPE_DOCKER_SCHEMA1); err != ErrManifestUnsigned {
+		t.Fatalf("expected %v got %v", ErrManifestUnsigned, err)
+	}
+	if err := permissive.check([]byte("not json"), MEDIATYPE_DOCKER_SCHEMA1_SIGNED); err == nil {
+		t.Fatal("expected invalid manifests to be rejected")
+	}
+
+	//schema2 and OCI manifests can't be signed
+	schema2 := []byte(`{"schemaVersion": 2, "config": {}, "layers": []}`)
+	for _, mediaType := range []string{MEDIATYPE_DOCKER_SCHEMA2, MEDIATYPE_OCI_MANIFEST} {
+		asserErrNil(permissive.check(schema2, mediaType), t)
+		if err := strict.check(schema2, mediaType); err != ErrSchema1Required {
+			t.Fatalf("%v: expected %v got %v", mediaType, ErrSchema1Required, err)
+		}
+	}
+	fmt.Printf("OK\n")
+}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	KRGO_HOME_ENV = "KRGO_HOME"
+	KRGO_DIR      = ".krgo"
 )
 
 //credentials format: <username>:<password>
@@ -14,33 +23,53 @@ func parseCredentials(credentials string) (string, string) {
 	return comps[0], comps[1]
 }
 
-//image format: <repository>/<image_name>:<tag>. tag defaults to latest, repository defaults to library
-func parseImageNameTag(imageNameTag string) (imageName, imageTag string) {
-	if strings.Contains(imageNameTag, ":") {
-		imageName = strings.SplitN(imageNameTag, ":", 2)[0]
-		imageTag = strings.SplitN(imageNameTag, ":", 2)[1]
-	} else {
-		imageName = imageNameTag
-		imageTag = "latest"
+//fileExists reports whether the named file or directory exists
+func fileExists(path string) bool {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false
+		}
 	}
+	return true
+}
 
-	if !strings.Contains(imageName, "/") {
-		imageName = "library/" + imageName
+//krgo state directory, $KRGO_HOME or ~/.krgo
+func krgoHome() string {
+	if dir := os.Getenv(KRGO_HOME_ENV); dir != "" {
+		return dir
 	}
-	return
+	return path.Join(os.Getenv("HOME"), KRGO_DIR)
 }
 
-//return whether imageName is an official image or not
-func isOfficialImage(imageName string) bool {
-	return strings.HasPrefix(imageName, "library/")
+//size format: <number>[K|M|G|T] (powers of 1024), e.g. 512K or 10M
+func parseSize(size string) (int64, error) {
+	multipliers := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	multiplier := int64(1)
+	if len(s) > 0 {
+		if m, ok := multipliers[s[len(s)-1:]]; ok {
+			multiplier = m
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (format: <number>[K|M|G|T])", size)
+	}
+	return int64(n * float64(multiplier)), nil
 }
 
-//fileExists reports whether the named file or directory exists
-func fileExists(path string) bool {
-	if _, err := os.Stat(path); err != nil {
-		if os.IsNotExist(err) {
-			return false
+//age format: go durations (e.g. 36h) or a number of days (e.g. 30d)
+func parseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err == nil && days >= 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
 		}
 	}
-	return true
+	d, err := time.ParseDuration(age)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q (format: 30d, 36h ...)", age)
+	}
+	return d, nil
 }